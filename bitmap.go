@@ -0,0 +1,422 @@
+package rsdic
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// BitmapIndex indexes a column of num rows of low cardinality by an RSDic
+// per distinct value, whose i-th bit is one if the i-th row has the value.
+//
+// The RSDic of the k-th distinct value (in the order of the first rows with
+// them) is stored in the subdirectory valueKKKK of the root directory, and the
+// catalog of the values and the metadata of their RSDics in manifest.bin.
+//
+// A Predicate over the values of a row is evaluated for all rows by reading
+// the RSDics of its values small block by small block (skipping runs common to
+// all of them), either into a new RSDic (Eval) or into the number of rows
+// satisfying it (Count).
+//
+// As the queries don't modify it, BitmapIndex is safe for concurrent queries.
+type BitmapIndex struct {
+	path   string
+	num    uint64
+	values []string
+	dicts  []*RSDic
+	index  map[string]int // of values
+}
+
+// bitmapManifest is the content of manifest.bin.
+type bitmapManifest struct {
+	Num    uint64
+	Values []string
+	Dicts  [][]byte // MarshalBinary of the RSDics of Values
+}
+
+func bitmapValuePath(dir string, k int) string {
+	return path.Join(dir, fmt.Sprintf("value%04d", k))
+}
+
+const (
+	kMaxBitmapValues = 4096 // the maximum number of distinct values of a BitmapIndex
+	kBitmapBatch     = 64   // the number of RSDics written at a time by BuildBitmapIndex
+)
+
+// BuildBitmapIndex returns a new BitmapIndex at dir of the column whose values
+// are given in the order of the rows by next, with its RSDics written and loaded
+// for reading. next is called until its second result is false.
+//
+// The indices of the values of the rows are written to a temporary file in dir,
+// from which the RSDics are written kBitmapBatch values at a time, reading it
+// once for each batch, so that at most kBitmapBatch RSDics are open for writing.
+// It fails if the column has more than kMaxBitmapValues distinct values.
+// On errors, the RSDics written so far are removed.
+func BuildBitmapIndex(dir string, next func() (value string, ok bool)) (*BitmapIndex, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	rows, err := os.CreateTemp(dir, "rows*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(rows.Name())
+	defer rows.Close()
+	bi := &BitmapIndex{path: dir, index: map[string]int{}}
+	w := bufio.NewWriter(rows)
+	buf := make([]byte, 4)
+	for ; ; bi.num++ {
+		value, ok := next()
+		if !ok {
+			break
+		}
+		k, ok := bi.index[value]
+		if !ok {
+			if len(bi.values) == kMaxBitmapValues {
+				return nil, fmt.Errorf("rsdic: BuildBitmapIndex: the column has more than %d distinct values", kMaxBitmapValues)
+			}
+			k = len(bi.values)
+			bi.index[value] = k
+			bi.values = append(bi.values, value)
+		}
+		binary.LittleEndian.PutUint32(buf, uint32(k))
+		if _, err := w.Write(buf); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	for from := 0; from < len(bi.values); from += kBitmapBatch {
+		dicts, err := bi.buildValues(rows, from, min(from+kBitmapBatch, len(bi.values)))
+		if err != nil {
+			removeValues(bi.dicts)
+			return nil, err
+		}
+		bi.dicts = append(bi.dicts, dicts...)
+	}
+	if err := bi.writeManifest(); err != nil {
+		removeValues(bi.dicts)
+		return nil, err
+	}
+	return bi, nil
+}
+
+// buildValues writes the RSDics of the values [from, to) from the indices of
+// the values of the rows in rows. On errors, the RSDics are removed.
+func (bi *BitmapIndex) buildValues(rows *os.File, from int, to int) ([]*RSDic, error) {
+	writers := []*bitWriter{}
+	outs := []*RSDic{}
+	for k := from; k < to; k++ {
+		out, err := newOpOutput(bitmapValuePath(bi.path, k))
+		if err != nil {
+			removeValues(outs)
+			return nil, err
+		}
+		writers = append(writers, &bitWriter{out: out})
+		outs = append(outs, out)
+	}
+	r := bufio.NewReader(io.NewSectionReader(rows, 0, int64(bi.num)*4))
+	buf := make([]byte, 4)
+	for row := uint64(0); row < bi.num; row++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			removeValues(outs)
+			return nil, err
+		}
+		k := int(binary.LittleEndian.Uint32(buf))
+		if k < from || k >= to {
+			continue
+		}
+		// the rows since the last one with the value don't have it
+		w := writers[k-from]
+		w.pushZeros(row - w.pushed())
+		w.push(true)
+	}
+	for _, w := range writers {
+		w.pushZeros(bi.num - w.pushed())
+		w.flush()
+		if err := closeOpOutput(w.out); err != nil {
+			removeValues(outs)
+			return nil, err
+		}
+	}
+	return outs, nil
+}
+
+// removeValues closes the RSDics of values and removes their directories.
+func removeValues(dicts []*RSDic) {
+	for _, dict := range dicts {
+		removeOutput(dict)
+		os.Remove(dict.path)
+	}
+}
+
+func (bi *BitmapIndex) writeManifest() error {
+	manifest := bitmapManifest{Num: bi.num, Values: bi.values}
+	for _, dict := range bi.dicts {
+		meta, err := dict.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		manifest.Dicts = append(manifest.Dicts, meta)
+	}
+	return writeManifest(bi.path, manifest)
+}
+
+// OpenBitmapIndex loads the BitmapIndex at dir written by BuildBitmapIndex.
+func OpenBitmapIndex(dir string) (*BitmapIndex, error) {
+	var manifest bitmapManifest
+	if err := readManifest(dir, &manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest.Values) != len(manifest.Dicts) {
+		return nil, fmt.Errorf("rsdic: catalog of %s has %d values and %d dictionaries", dir, len(manifest.Values), len(manifest.Dicts))
+	}
+	bi := &BitmapIndex{path: dir, num: manifest.Num, values: manifest.Values, index: map[string]int{}}
+	for k, meta := range manifest.Dicts {
+		dict, err := New(bitmapValuePath(dir, k))
+		if err != nil {
+			bi.Close()
+			return nil, err
+		}
+		if err := dict.UnmarshalBinary(meta); err != nil {
+			bi.Close()
+			return nil, err
+		}
+		if dict.Num() != bi.num {
+			bi.Close()
+			return nil, fmt.Errorf("rsdic: dictionary of %q in %s has length %d for %d rows", manifest.Values[k], dir, dict.Num(), bi.num)
+		}
+		if err := dict.LoadReader(); err != nil {
+			bi.Close()
+			return nil, err
+		}
+		bi.dicts = append(bi.dicts, dict)
+		bi.index[manifest.Values[k]] = k
+	}
+	return bi, nil
+}
+
+// Close releases the readers of the dictionaries.
+func (bi *BitmapIndex) Close() error {
+	var err error
+	for _, dict := range bi.dicts {
+		if closeErr := dict.CloseReader(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Num returns the number of rows
+func (bi *BitmapIndex) Num() uint64 {
+	return bi.num
+}
+
+// Values returns the distinct values in the order of their first rows
+func (bi *BitmapIndex) Values() []string {
+	return append([]string{}, bi.values...)
+}
+
+// Dict returns the RSDic of the rows with value, or nil if no row has it
+func (bi *BitmapIndex) Dict(value string) *RSDic {
+	if k, ok := bi.index[value]; ok {
+		return bi.dicts[k]
+	}
+	return nil
+}
+
+type predicateOp int
+
+const (
+	predicateIn predicateOp = iota
+	predicateNot
+	predicateAnd
+	predicateOr
+)
+
+// Predicate is a boolean predicate over the value of a row, built from
+// Eq and In by And, Or and Not.
+type Predicate struct {
+	op     predicateOp
+	values []string    // of In
+	args   []Predicate // of Not, And and Or
+}
+
+// Eq returns the predicate that the value is value.
+func Eq(value string) Predicate {
+	return In(value)
+}
+
+// In returns the predicate that the value is one of values.
+func In(values ...string) Predicate {
+	return Predicate{op: predicateIn, values: values}
+}
+
+// And returns the predicate that p and all of qs hold.
+func (p Predicate) And(qs ...Predicate) Predicate {
+	return Predicate{op: predicateAnd, args: append([]Predicate{p}, qs...)}
+}
+
+// Or returns the predicate that p or any of qs holds.
+func (p Predicate) Or(qs ...Predicate) Predicate {
+	return Predicate{op: predicateOr, args: append([]Predicate{p}, qs...)}
+}
+
+// Not returns the predicate that p doesn't hold.
+func (p Predicate) Not() Predicate {
+	return Predicate{op: predicateNot, args: []Predicate{p}}
+}
+
+// compile returns the function of p from the current words of the RSDics,
+// appending the RSDics of the values of p to dicts (once for each).
+func (bi *BitmapIndex) compile(p Predicate, slots map[int]int, dicts *[]*RSDic) func(words []uint64) uint64 {
+	switch p.op {
+	case predicateIn:
+		ss := []int{}
+		for _, value := range p.values {
+			k, ok := bi.index[value]
+			if !ok {
+				continue
+			}
+			if _, ok := slots[k]; !ok {
+				slots[k] = len(*dicts)
+				*dicts = append(*dicts, bi.dicts[k])
+			}
+			ss = append(ss, slots[k])
+		}
+		return func(words []uint64) uint64 {
+			x := uint64(0)
+			for _, s := range ss {
+				x |= words[s]
+			}
+			return x
+		}
+	case predicateNot:
+		f := bi.compile(p.args[0], slots, dicts)
+		return func(words []uint64) uint64 { return ^f(words) }
+	case predicateAnd:
+		fs := bi.compileArgs(p.args, slots, dicts)
+		return func(words []uint64) uint64 {
+			x := ^uint64(0)
+			for _, f := range fs {
+				x &= f(words)
+			}
+			return x
+		}
+	default:
+		fs := bi.compileArgs(p.args, slots, dicts)
+		return func(words []uint64) uint64 {
+			x := uint64(0)
+			for _, f := range fs {
+				x |= f(words)
+			}
+			return x
+		}
+	}
+}
+
+func (bi *BitmapIndex) compileArgs(args []Predicate, slots map[int]int, dicts *[]*RSDic) []func([]uint64) uint64 {
+	fs := make([]func([]uint64) uint64, len(args))
+	for i, arg := range args {
+		fs[i] = bi.compile(arg, slots, dicts)
+	}
+	return fs
+}
+
+// eval calls emit with the words of p for all rows and their numbers of bits.
+// As in opCounts, the blocks in runs of all RSDics are evaluated at once,
+// for which emit gets a uniform word with more than 64 bits, and uniform
+// small blocks are not decoded.
+func (bi *BitmapIndex) eval(t *tracker, p Predicate, emit func(word uint64, n uint64)) error {
+	dicts := []*RSDic{}
+	f := bi.compile(p, map[int]int{}, &dicts)
+	wrs := make([]*wordReader, len(dicts))
+	for i, dict := range dicts {
+		wrs[i] = dict.newWordReader(0)
+	}
+	words := make([]uint64, len(dicts))
+	uniform := make([]bool, len(dicts))
+	blockNum := floor(bi.num, kSmallBlockSize)
+	for sblock := uint64(0); sblock < blockNum; {
+		n := blockNum - sblock
+		for i, wr := range wrs {
+			words[i], uniform[i] = uniformWord(wr.rank())
+			n = min(n, wr.runLeft())
+		}
+		if n > 0 {
+			for _, wr := range wrs {
+				wr.skipRun(n)
+			}
+		} else {
+			n = 1
+			for i, wr := range wrs {
+				if uniform[i] {
+					wr.skip()
+				} else {
+					words[i] = wr.decode()
+				}
+			}
+		}
+		nbits := min((sblock+n)*kSmallBlockSize, bi.num) - sblock*kSmallBlockSize
+		emit(f(words), nbits)
+		sblock += n
+		if err := t.add(nbits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Eval returns a new RSDic at outPath of the rows satisfying p.
+func (bi *BitmapIndex) Eval(p Predicate, outPath string) (*RSDic, error) {
+	return bi.EvalContext(context.Background(), p, outPath)
+}
+
+// EvalContext is Eval with cancellation and progress (See context.go).
+func (bi *BitmapIndex) EvalContext(ctx context.Context, p Predicate, outPath string) (*RSDic, error) {
+	out, err := newOpOutput(outPath)
+	if err != nil {
+		return nil, err
+	}
+	err = bi.eval(newTracker(ctx, bi.num), p, func(word uint64, n uint64) {
+		for ; n > 0; n -= min(n, kSmallBlockSize) {
+			out.pushWord(word, min(n, kSmallBlockSize))
+		}
+	})
+	if err != nil {
+		removeOutput(out)
+		return nil, err
+	}
+	if err := closeOpOutput(out); err != nil {
+		removeOutput(out)
+		return nil, err
+	}
+	return out, nil
+}
+
+// Count returns the number of rows satisfying p without building their RSDic.
+func (bi *BitmapIndex) Count(p Predicate) (uint64, error) {
+	return bi.CountContext(context.Background(), p)
+}
+
+// CountContext is Count with cancellation and progress (See context.go).
+func (bi *BitmapIndex) CountContext(ctx context.Context, p Predicate) (uint64, error) {
+	count := uint64(0)
+	err := bi.eval(newTracker(ctx, bi.num), p, func(word uint64, n uint64) {
+		if n < kSmallBlockSize {
+			count += uint64(popCount(word & (1<<n - 1)))
+		} else {
+			// the word is uniform if n > 64
+			count += uint64(popCount(word)) * n / kSmallBlockSize
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
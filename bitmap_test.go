@@ -0,0 +1,197 @@
+package rsdic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBitmapIndex(t *testing.T) {
+	// a column with skewed values and long runs of the same value
+	values := []string{"ok", "warn", "error", "debug", "fatal"}
+	column := make([]string, 50000)
+	for i := range column {
+		switch {
+		case i > 0 && rand.Intn(20) != 0:
+			column[i] = column[i-1]
+		case rand.Intn(4) != 0:
+			column[i] = values[0]
+		default:
+			column[i] = values[rand.Intn(len(values))]
+		}
+	}
+	feed := func(column []string) func() (string, bool) {
+		return func() (string, bool) {
+			if len(column) == 0 {
+				return "", false
+			}
+			value := column[0]
+			column = column[1:]
+			return value, true
+		}
+	}
+	built, err := BuildBitmapIndex("test/bmindex", feed(column))
+	if err != nil {
+		panic(err)
+	}
+	defer built.Close()
+
+	is := func(vs ...string) func(string) bool {
+		return func(v string) bool {
+			for _, w := range vs {
+				if v == w {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	predicates := []struct {
+		p     Predicate
+		match func(string) bool
+	}{
+		{Eq("warn"), is("warn")},
+		{In("error", "fatal", "missing"), is("error", "fatal")},
+		{Eq("missing"), is()},
+		{Eq("ok").Not(), func(v string) bool { return v != "ok" }},
+		{In("ok", "warn").And(In("warn", "error")), is("warn")},
+		{Eq("debug").Or(Eq("fatal"), Eq("error").Not().Not()), is("debug", "fatal", "error")},
+		{Eq("ok").Or(Eq("warn")).Not().And(Eq("fatal").Not()), is("error", "debug")},
+		{In().Not(), func(string) bool { return true }},
+	}
+	checkBitmapIndex := func(bi *BitmapIndex) {
+		So(bi.Num(), ShouldEqual, len(column))
+		So(len(bi.Values()), ShouldEqual, len(values))
+		So(bi.Dict("missing"), ShouldBeNil)
+		So(bi.Dict("ok").Num(), ShouldEqual, len(column))
+		for k, pred := range predicates {
+			expected := uint64(0)
+			for _, v := range column {
+				if pred.match(v) {
+					expected++
+				}
+			}
+			count, err := bi.Count(pred.p)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, expected)
+
+			rs, err := bi.Eval(pred.p, fmt.Sprintf("test/bmindex_out%d", k))
+			So(err, ShouldBeNil)
+			So(rs.Num(), ShouldEqual, len(column))
+			So(rs.OneNum(), ShouldEqual, expected)
+			for n := 0; n < 100; n++ {
+				i := rand.Intn(len(column))
+				So(rs.Bit(uint64(i)), ShouldEqual, pred.match(column[i]))
+			}
+			So(rs.CloseReader(), ShouldBeNil)
+		}
+	}
+
+	Convey("When a bitmap index is built", t, func() {
+		checkBitmapIndex(built)
+	})
+
+	Convey("When a bitmap index is opened", t, func() {
+		bi, err := OpenBitmapIndex("test/bmindex")
+		So(err, ShouldBeNil)
+		defer bi.Close()
+		checkBitmapIndex(bi)
+	})
+
+	Convey("When a bitmap index has runs longer than large blocks", t, func() {
+		long := []string{}
+		for len(long) < 30*kLargeBlockSize {
+			value := values[rand.Intn(2)]
+			for n := rand.Intn(3*kLargeBlockSize) + 1; n > 0; n-- {
+				long = append(long, value)
+			}
+		}
+		for i := 0; i < 100; i++ {
+			long = append(long, values[rand.Intn(len(values))])
+		}
+		os.RemoveAll("test/bmindex_long")
+		bi, err := BuildBitmapIndex("test/bmindex_long", feed(long))
+		So(err, ShouldBeNil)
+		defer bi.Close()
+		So(bi.Dict("ok").runNum(), ShouldBeGreaterThan, 0)
+		for k, pred := range predicates {
+			expected := []uint8{}
+			for _, v := range long {
+				if pred.match(v) {
+					expected = append(expected, 1)
+				} else {
+					expected = append(expected, 0)
+				}
+			}
+			count, err := bi.Count(pred.p)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, newRawBitVector(expected).oneNum)
+			rs, err := bi.Eval(pred.p, fmt.Sprintf("test/bmindex_long_out%d", k))
+			So(err, ShouldBeNil)
+			So(rs.GetWords(0, rs.Num(), []uint64{}), ShouldResemble, rawWords(expected, 0, uint64(len(expected))))
+			So(rs.CloseReader(), ShouldBeNil)
+		}
+	})
+
+	Convey("When an evaluation is cancelled", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := built.EvalContext(ctx, Eq("ok"), "test/bmindex_cancelled")
+		So(errors.Is(err, context.Canceled), ShouldBeTrue)
+		_, err = built.CountContext(ctx, Eq("ok"))
+		So(errors.Is(err, context.Canceled), ShouldBeTrue)
+	})
+
+	Convey("When a bitmap index has no rows", t, func() {
+		bi, err := BuildBitmapIndex("test/bmindex_empty", feed(nil))
+		So(err, ShouldBeNil)
+		So(bi.Num(), ShouldEqual, 0)
+		So(bi.Values(), ShouldBeEmpty)
+		count, err := bi.Count(Eq("ok").Not())
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 0)
+		So(bi.Close(), ShouldBeNil)
+	})
+
+	Convey("When a bitmap index has more values than are written at a time", t, func() {
+		many := make([]string, 3000)
+		for i := range many {
+			many[i] = fmt.Sprint(rand.Intn(2*kBitmapBatch + 10))
+		}
+		os.RemoveAll("test/bmindex_many")
+		bi, err := BuildBitmapIndex("test/bmindex_many", feed(many))
+		So(err, ShouldBeNil)
+		defer bi.Close()
+		So(len(bi.Values()), ShouldBeGreaterThan, 2*kBitmapBatch)
+		for _, value := range bi.Values() {
+			dict := bi.Dict(value)
+			So(dict.Num(), ShouldEqual, len(many))
+			for i := range many {
+				if dict.Bit(uint64(i)) != (many[i] == value) {
+					So(dict.Bit(uint64(i)), ShouldEqual, many[i] == value)
+				}
+			}
+		}
+		entries, err := os.ReadDir("test/bmindex_many")
+		So(err, ShouldBeNil)
+		So(len(entries), ShouldEqual, len(bi.Values())+1) // with manifest.bin
+	})
+
+	Convey("When a bitmap index has too many values", t, func() {
+		many := make([]string, kMaxBitmapValues+1)
+		for i := range many {
+			many[i] = fmt.Sprint(i)
+		}
+		os.RemoveAll("test/bmindex_toomany")
+		_, err := BuildBitmapIndex("test/bmindex_toomany", feed(many))
+		So(err, ShouldNotBeNil)
+		entries, err := os.ReadDir("test/bmindex_toomany")
+		So(err, ShouldBeNil)
+		So(entries, ShouldBeEmpty)
+	})
+}
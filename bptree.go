@@ -0,0 +1,523 @@
+package rsdic
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+
+	"golang.org/x/exp/mmap"
+)
+
+// BPTree represents an ordinal tree of num nodes by balanced parentheses [1]:
+// the depth-first traversal from the root writes an open parenthesis (a one)
+// when it enters a node and a close parenthesis (a zero) when it leaves it.
+// A node is identified by the position of its open parenthesis, and the root
+// is 0. The i-th node in preorder is at Node(i).
+//
+// The queries are searches for the positions where the excess E(i), the number
+// of opens minus the number of closes in B[0...i], reaches a value, such as
+// the close of an open i being the first j > i with E(j) = E(i) - 1.
+// They are answered by the range min-max tree [2], a complete binary tree over
+// the blocks of kRMMBlockSize bits whose nodes hold the minimums of the excess
+// in their blocks, with the scans within blocks skipping bytes by tables.
+//
+// The parentheses are stored as an RSDic in the subdirectory bp of the
+// directory, the range min-max tree in rmm.bin as little-endian 64-bit words
+// in the order of a binary heap, which is mapped for reading, and the metadata
+// of the RSDic in manifest.bin.
+//
+// The queries return Len() for a missing node (e.g. Enclose of the root),
+// and panic for a position which is not a node. As the queries don't modify
+// it, BPTree is safe for concurrent queries.
+//
+// [1] "Succinct Representation of Balanced Parentheses and Static Trees",
+// J. Ian Munro and Venkatesh Raman, SIAM J. Comput. 2001
+// [2] "Fully Functional Static and Dynamic Succinct Trees",
+// Gonzalo Navarro and Kunihiko Sadakane, ACM TALG 2014
+type BPTree struct {
+	path   string
+	num    uint64
+	leaves uint64 // the offset of the leaves in the range min-max tree
+	bits   *RSDic
+	rmm    *mmap.ReaderAt
+}
+
+// bpManifest is the content of manifest.bin.
+type bpManifest struct {
+	Num  uint64
+	Bits []byte // MarshalBinary of the RSDic
+}
+
+const (
+	BP_DIR = "bp"
+	RMM_FN = "rmm.bin"
+
+	kRMMBlockSize = kLargeBlockSize
+)
+
+// the change of the excess by a byte and its minimum within the byte
+var bpByteExcess, bpByteMinExcess = bpByteTables()
+
+func bpByteTables() (excess [256]int8, minExcess [256]int8) {
+	for b := 0; b < 256; b++ {
+		e, m := int8(0), int8(8)
+		for i := 0; i < 8; i++ {
+			if b>>i&1 == 1 {
+				e++
+			} else {
+				e--
+			}
+			m = min(m, e)
+		}
+		excess[b], minExcess[b] = e, m
+	}
+	return
+}
+
+// rmmLeaves returns the number of leaves of the range min-max tree for n bits,
+// a power of two.
+func rmmLeaves(n uint64) uint64 {
+	leaves := uint64(1)
+	for leaves*kRMMBlockSize < n {
+		leaves *= 2
+	}
+	return leaves
+}
+
+// BuildBPTree returns a new BPTree at dir of the tree whose degrees are given in
+// preorder by next, with its files written and loaded for reading.
+// next is called until all nodes are given, and its second result is false if
+// there are no more nodes, which is an error unless no node is given.
+func BuildBPTree(dir string, next func() (degree uint64, ok bool)) (*BPTree, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	out, err := newOpOutput(path.Join(dir, BP_DIR))
+	if err != nil {
+		return nil, err
+	}
+	w := &bitWriter{out: out}
+	mins := []int64{}
+	excess, pos := int64(0), uint64(0)
+	push := func(open bool) {
+		w.push(open)
+		if open {
+			excess++
+		} else {
+			excess--
+		}
+		if pos%kRMMBlockSize == 0 {
+			mins = append(mins, excess)
+		}
+		mins[len(mins)-1] = min(mins[len(mins)-1], excess)
+		pos++
+	}
+	// the numbers of children not given yet of the open nodes
+	pending := []uint64{}
+	num := uint64(0)
+	for {
+		degree, ok := next()
+		if !ok {
+			if num == 0 {
+				break
+			}
+			removeOutput(out)
+			return nil, fmt.Errorf("rsdic: tree ended with %d open nodes", len(pending))
+		}
+		push(true)
+		num++
+		if degree > 0 {
+			pending = append(pending, degree)
+			continue
+		}
+		push(false)
+		for len(pending) > 0 {
+			if pending[len(pending)-1]--; pending[len(pending)-1] > 0 {
+				break
+			}
+			pending = pending[:len(pending)-1]
+			push(false)
+		}
+		if len(pending) == 0 {
+			break
+		}
+	}
+	w.flush()
+	if err := closeOpOutput(out); err != nil {
+		return nil, err
+	}
+	bp := &BPTree{path: dir, num: num, leaves: rmmLeaves(2 * num), bits: out}
+	if err := bp.writeRMM(mins); err != nil {
+		bp.Close()
+		return nil, err
+	}
+	manifest := bpManifest{Num: num}
+	meta, err := out.MarshalBinary()
+	if err == nil {
+		manifest.Bits = meta
+		err = writeManifest(dir, manifest)
+	}
+	if err == nil {
+		bp.rmm, err = mmap.Open(path.Join(dir, RMM_FN))
+	}
+	if err != nil {
+		bp.Close()
+		return nil, err
+	}
+	return bp, nil
+}
+
+// BuildBPTreeFromEdges returns a new BPTree at dir of the tree given by edges of
+// (parent, child) IDs, where the children of a node are ordered as in edges.
+// The root is the only parent which is not a child. It also returns the IDs of
+// the nodes in preorder, i.e. the node Node(i) of the BPTree is ids[i].
+// An empty edges gives an empty tree.
+func BuildBPTreeFromEdges(dir string, edges [][2]uint64) (*BPTree, []uint64, error) {
+	children, root, err := edgeChildren(edges)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := []uint64{}
+	if len(edges) > 0 {
+		for stack := []uint64{root}; len(stack) > 0; {
+			id := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			ids = append(ids, id)
+			for i := len(children[id]) - 1; i >= 0; i-- {
+				stack = append(stack, children[id][i])
+			}
+		}
+	}
+	i := 0
+	bp, err := BuildBPTree(dir, func() (uint64, bool) {
+		if i == len(ids) {
+			return 0, false
+		}
+		i++
+		return uint64(len(children[ids[i-1]])), true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return bp, ids, nil
+}
+
+// writeRMM writes the range min-max tree with the minimums of the blocks to rmm.bin.
+func (bp *BPTree) writeRMM(mins []int64) error {
+	tree := make([]int64, 2*bp.leaves)
+	for i := range tree {
+		tree[i] = math.MaxInt64
+	}
+	copy(tree[bp.leaves:], mins)
+	for node := bp.leaves - 1; node > 0; node-- {
+		tree[node] = min(tree[2*node], tree[2*node+1])
+	}
+	words := make([]uint64, len(tree))
+	for i, m := range tree {
+		words[i] = uint64(m)
+	}
+	return writeUint64File(path.Join(bp.path, RMM_FN), words)
+}
+
+// OpenBPTree loads the BPTree at dir written by BuildBPTree.
+func OpenBPTree(dir string) (*BPTree, error) {
+	var manifest bpManifest
+	if err := readManifest(dir, &manifest); err != nil {
+		return nil, err
+	}
+	bits, err := New(path.Join(dir, BP_DIR))
+	if err != nil {
+		return nil, err
+	}
+	if err := bits.UnmarshalBinary(manifest.Bits); err != nil {
+		return nil, err
+	}
+	if bits.Num() != 2*manifest.Num || bits.OneNum() != manifest.Num {
+		return nil, fmt.Errorf("rsdic: parentheses of %s have %d opens and %d closes for %d nodes",
+			dir, bits.OneNum(), bits.ZeroNum(), manifest.Num)
+	}
+	if err := bits.LoadReader(); err != nil {
+		return nil, err
+	}
+	bp := &BPTree{path: dir, num: manifest.Num, leaves: rmmLeaves(2 * manifest.Num), bits: bits}
+	if bp.rmm, err = mmap.Open(path.Join(dir, RMM_FN)); err != nil {
+		bp.Close()
+		return nil, err
+	}
+	if uint64(bp.rmm.Len()) != 2*bp.leaves*8 {
+		bp.Close()
+		return nil, fmt.Errorf("rsdic: %s of %s has %d bytes for %d nodes", RMM_FN, dir, bp.rmm.Len(), manifest.Num)
+	}
+	return bp, nil
+}
+
+// Close releases the reader of the parentheses and the mapping of the range min-max tree.
+func (bp *BPTree) Close() error {
+	err := bp.bits.CloseReader()
+	if bp.rmm != nil {
+		if closeErr := bp.rmm.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Num returns the number of nodes
+func (bp *BPTree) Num() uint64 {
+	return bp.num
+}
+
+// Len returns the number of parentheses, i.e. 2*Num()
+func (bp *BPTree) Len() uint64 {
+	return 2 * bp.num
+}
+
+func (bp *BPTree) checkNode(name string, v uint64) {
+	if v >= bp.Len() || !bp.bits.Bit(v) {
+		panic(fmt.Sprintf("%s: position %d is not a node (len = %d)", name, v, bp.Len()))
+	}
+}
+
+// Node returns the (i+1)-th node in preorder
+func (bp *BPTree) Node(i uint64) uint64 {
+	if i >= bp.num {
+		panic(fmt.Sprintf("Node: preorder %d is out of bounds (num = %d)", i, bp.num))
+	}
+	return bp.bits.Select1(i)
+}
+
+// Preorder returns the number of nodes before v in preorder
+func (bp *BPTree) Preorder(v uint64) uint64 {
+	bp.checkNode("Preorder", v)
+	return bp.bits.Rank(v, true)
+}
+
+// FindClose returns the position of the close parenthesis of v
+func (bp *BPTree) FindClose(v uint64) uint64 {
+	bp.checkNode("FindClose", v)
+	j, _ := bp.fwdSearch(v, bp.excessBefore(v))
+	return j
+}
+
+// Enclose returns the parent of v, or Len() if v is the root
+func (bp *BPTree) Enclose(v uint64) uint64 {
+	bp.checkNode("Enclose", v)
+	return bp.bwdSearch(v, bp.excessBefore(v)-1)
+}
+
+// SubtreeSize returns the number of nodes in the subtree of v, including v
+func (bp *BPTree) SubtreeSize(v uint64) uint64 {
+	return (bp.FindClose(v) - v + 1) / 2
+}
+
+// Depth returns the number of edges from the root to v
+func (bp *BPTree) Depth(v uint64) uint64 {
+	bp.checkNode("Depth", v)
+	return uint64(bp.excessBefore(v))
+}
+
+// LCA returns the lowest common ancestor of u and v
+func (bp *BPTree) LCA(u uint64, v uint64) uint64 {
+	bp.checkNode("LCA", u)
+	bp.checkNode("LCA", v)
+	if u > v {
+		u, v = v, u
+	}
+	if v < bp.FindClose(u) {
+		return u
+	}
+	// the minimum excess between them is that at the close of the child
+	// of the ancestor containing u, which is at the open of the ancestor
+	return bp.bwdSearch(u, bp.rangeMin(u, v)-1)
+}
+
+// LevelAncestor returns the ancestor of v d levels above it (v itself for d = 0),
+// or Len() if v has less than d ancestors
+func (bp *BPTree) LevelAncestor(v uint64, d uint64) uint64 {
+	bp.checkNode("LevelAncestor", v)
+	e := bp.excessBefore(v)
+	if d > uint64(e) {
+		return bp.Len()
+	}
+	return bp.bwdSearch(v, e-int64(d))
+}
+
+// excessBefore returns E(i-1), the excess of B[0...i).
+func (bp *BPTree) excessBefore(i uint64) int64 {
+	return 2*int64(bp.bits.Rank(i, true)) - int64(i)
+}
+
+func (bp *BPTree) rmmAt(node uint64) int64 {
+	return int64(readUint64(bp.rmm, node))
+}
+
+// fwdSearch returns the smallest j > i with E(j) <= target.
+// It returns Len() and false if there is none.
+func (bp *BPTree) fwdSearch(i uint64, target int64) (uint64, bool) {
+	block := i / kRMMBlockSize
+	end := min((block+1)*kRMMBlockSize, bp.Len())
+	if j, _, ok := bp.fwdScan(i+1, end, bp.excessBefore(i+1), target); ok {
+		return j, true
+	}
+	for node := bp.leaves + block; node > 1; node /= 2 {
+		if node%2 == 1 || bp.rmmAt(node+1) > target {
+			continue
+		}
+		// the leftmost block after i reaching target
+		for node++; node < bp.leaves; {
+			if bp.rmmAt(2*node) <= target {
+				node = 2 * node
+			} else {
+				node = 2*node + 1
+			}
+		}
+		start := (node - bp.leaves) * kRMMBlockSize
+		j, _, ok := bp.fwdScan(start, min(start+kRMMBlockSize, bp.Len()), bp.excessBefore(start), target)
+		return j, ok
+	}
+	return bp.Len(), false
+}
+
+// bwdSearch returns k+1 for the largest k < i with E(k) <= target, where E(-1) = 0.
+// It returns Len() if there is none.
+func (bp *BPTree) bwdSearch(i uint64, target int64) uint64 {
+	if i > 0 {
+		block := (i - 1) / kRMMBlockSize
+		if k, ok := bp.bwdScan(block*kRMMBlockSize, i, bp.excessBefore(i), target); ok {
+			return k + 1
+		}
+		for node := bp.leaves + block; node > 1; node /= 2 {
+			if node%2 == 0 || bp.rmmAt(node-1) > target {
+				continue
+			}
+			// the rightmost block before i reaching target
+			for node--; node < bp.leaves; {
+				if bp.rmmAt(2*node+1) <= target {
+					node = 2*node + 1
+				} else {
+					node = 2 * node
+				}
+			}
+			start := (node - bp.leaves) * kRMMBlockSize
+			end := min(start+kRMMBlockSize, bp.Len())
+			k, _ := bp.bwdScan(start, end, bp.excessBefore(end), target)
+			return k + 1
+		}
+	}
+	if target >= 0 {
+		return 0
+	}
+	return bp.Len()
+}
+
+// rangeMin returns the minimum of E(k) for k in [l, r].
+func (bp *BPTree) rangeMin(l uint64, r uint64) int64 {
+	lblock, rblock := l/kRMMBlockSize, r/kRMMBlockSize
+	if lblock == rblock {
+		return bp.minScan(l, r+1, bp.excessBefore(l))
+	}
+	m := min(bp.minScan(l, (lblock+1)*kRMMBlockSize, bp.excessBefore(l)),
+		bp.minScan(rblock*kRMMBlockSize, r+1, bp.excessBefore(rblock*kRMMBlockSize)))
+	for lo, hi := bp.leaves+lblock+1, bp.leaves+rblock; lo < hi; lo, hi = lo/2, hi/2 {
+		if lo%2 == 1 {
+			m = min(m, bp.rmmAt(lo))
+			lo++
+		}
+		if hi%2 == 1 {
+			hi--
+			m = min(m, bp.rmmAt(hi))
+		}
+	}
+	return m
+}
+
+// fwdScan returns the smallest j in [from, to) with E(j) <= target, given
+// cur = E(from-1), or false and E(to-1) if there is none.
+func (bp *BPTree) fwdScan(from uint64, to uint64, cur int64, target int64) (uint64, int64, bool) {
+	if from >= to {
+		return to, cur, false
+	}
+	n := to - from
+	words := bp.bits.GetWords(from, n, nil)
+	for r := uint64(0); r < n; {
+		word := words[r/kSmallBlockSize] >> (r % kSmallBlockSize)
+		if r%8 == 0 && r+8 <= n {
+			if b := uint8(word); cur+int64(bpByteMinExcess[b]) > target {
+				cur += int64(bpByteExcess[b])
+				r += 8
+				continue
+			}
+		}
+		if word&1 == 1 {
+			cur++
+		} else {
+			cur--
+		}
+		if cur <= target {
+			return from + r, cur, true
+		}
+		r++
+	}
+	return to, cur, false
+}
+
+// bwdScan returns the largest k in [from, to) with E(k) <= target,
+// given cur = E(to-1), or false if there is none.
+func (bp *BPTree) bwdScan(from uint64, to uint64, cur int64, target int64) (uint64, bool) {
+	if from >= to {
+		return 0, false
+	}
+	n := to - from
+	words := bp.bits.GetWords(from, n, nil)
+	for r := n; r > 0; {
+		if r%8 == 0 {
+			b := uint8(words[(r-8)/kSmallBlockSize] >> ((r - 8) % kSmallBlockSize))
+			// the excess before the byte
+			before := cur - int64(bpByteExcess[b])
+			if before+int64(bpByteMinExcess[b]) > target {
+				cur = before
+				r -= 8
+				continue
+			}
+		}
+		if cur <= target {
+			return from + r - 1, true
+		}
+		if words[(r-1)/kSmallBlockSize]>>((r-1)%kSmallBlockSize)&1 == 1 {
+			cur--
+		} else {
+			cur++
+		}
+		r--
+	}
+	return 0, false
+}
+
+// minScan returns the minimum of E(k) for k in [from, to), given cur = E(from-1).
+func (bp *BPTree) minScan(from uint64, to uint64, cur int64) int64 {
+	m := int64(math.MaxInt64)
+	if from >= to {
+		return m
+	}
+	n := to - from
+	words := bp.bits.GetWords(from, n, nil)
+	for r := uint64(0); r < n; {
+		word := words[r/kSmallBlockSize] >> (r % kSmallBlockSize)
+		if r%8 == 0 && r+8 <= n {
+			b := uint8(word)
+			m = min(m, cur+int64(bpByteMinExcess[b]))
+			cur += int64(bpByteExcess[b])
+			r += 8
+			continue
+		}
+		if word&1 == 1 {
+			cur++
+		} else {
+			cur--
+		}
+		m = min(m, cur)
+		r++
+	}
+	return m
+}
@@ -0,0 +1,130 @@
+package rsdic
+
+import (
+	"math/rand"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBPTree(t *testing.T) {
+	// a random tree with shuffled IDs, with a long path to make the searches cross blocks
+	ids := rand.Perm(6000)
+	parents := make([]int, len(ids))
+	edges := [][2]uint64{}
+	for i := 1; i < len(ids); i++ {
+		parents[i] = rand.Intn(i)
+		if i < 1500 || rand.Intn(2) == 0 {
+			parents[i] = i - 1 - rand.Intn(min(i, 2))
+		}
+		edges = append(edges, [2]uint64{uint64(ids[parents[i]]), uint64(ids[i])})
+	}
+	index := map[uint64]int{}
+	for i, id := range ids {
+		index[uint64(id)] = i
+	}
+	depths := make([]uint64, len(ids))
+	sizes := make([]uint64, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		sizes[i]++
+		if i > 0 {
+			sizes[parents[i]] += sizes[i]
+		}
+	}
+	for i := 1; i < len(ids); i++ {
+		depths[i] = depths[parents[i]] + 1
+	}
+	ancestor := func(i int, d uint64) int {
+		for ; d > 0; d-- {
+			i = parents[i]
+		}
+		return i
+	}
+	built, order, err := BuildBPTreeFromEdges("test/bptree", edges)
+	if err != nil {
+		panic(err)
+	}
+	defer built.Close()
+
+	checkBPTree := func(bp *BPTree) {
+		So(bp.Num(), ShouldEqual, len(ids))
+		So(bp.Len(), ShouldEqual, 2*len(ids))
+		So(order[0], ShouldEqual, ids[0])
+		node := make([]uint64, len(ids)) // of the indexes of ids
+		for k, id := range order {
+			node[index[id]] = bp.Node(uint64(k))
+			So(bp.Preorder(node[index[id]]), ShouldEqual, k)
+		}
+		So(bp.FindClose(0), ShouldEqual, bp.Len()-1)
+		So(bp.Enclose(0), ShouldEqual, bp.Len())
+		for n := 0; n < 2000; n++ {
+			i := rand.Intn(len(ids))
+			v := node[i]
+			So(bp.SubtreeSize(v), ShouldEqual, sizes[i])
+			So(bp.FindClose(v), ShouldEqual, v+2*sizes[i]-1)
+			So(bp.Depth(v), ShouldEqual, depths[i])
+			if i > 0 {
+				So(bp.Enclose(v), ShouldEqual, node[parents[i]])
+			}
+			d := uint64(rand.Intn(int(depths[i]) + 1))
+			So(bp.LevelAncestor(v, d), ShouldEqual, node[ancestor(i, d)])
+			So(bp.LevelAncestor(v, depths[i]+1), ShouldEqual, bp.Len())
+
+			j := rand.Intn(len(ids))
+			a, b := i, j
+			for depths[a] > depths[b] {
+				a = parents[a]
+			}
+			for depths[b] > depths[a] {
+				b = parents[b]
+			}
+			for a != b {
+				a, b = parents[a], parents[b]
+			}
+			So(bp.LCA(v, node[j]), ShouldEqual, node[a])
+		}
+		So(func() { bp.Depth(bp.FindClose(0)) }, ShouldPanic)
+	}
+
+	Convey("When a BP tree is built from edges", t, func() {
+		checkBPTree(built)
+	})
+
+	Convey("When a BP tree is opened", t, func() {
+		bp, err := OpenBPTree("test/bptree")
+		So(err, ShouldBeNil)
+		defer bp.Close()
+		checkBPTree(bp)
+	})
+
+	Convey("When a BP tree is built from degrees", t, func() {
+		// (()(()())) : 0 -> (1, 3), 3 -> (4, 6)
+		degrees := []uint64{2, 0, 2, 0, 0}
+		next := func() (uint64, bool) {
+			if len(degrees) == 0 {
+				return 0, false
+			}
+			degree := degrees[0]
+			degrees = degrees[1:]
+			return degree, true
+		}
+		bp, err := BuildBPTree("test/bptree_small", next)
+		So(err, ShouldBeNil)
+		So(bp.Num(), ShouldEqual, 5)
+		So(bp.FindClose(3), ShouldEqual, 8)
+		So(bp.Enclose(6), ShouldEqual, 3)
+		So(bp.LCA(1, 6), ShouldEqual, 0)
+		So(bp.LCA(4, 6), ShouldEqual, 3)
+		So(bp.SubtreeSize(3), ShouldEqual, 3)
+		So(bp.Close(), ShouldBeNil)
+
+		degrees = []uint64{2, 1}
+		_, err = BuildBPTree("test/bptree_small", next)
+		So(err, ShouldNotBeNil)
+
+		bp, err = BuildBPTree("test/bptree_small", next)
+		So(err, ShouldBeNil)
+		So(bp.Num(), ShouldEqual, 0)
+		So(bp.Close(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,212 @@
+package rsdic
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// kParallelSegmentSize is the maximum number of bits encoded by a worker at once.
+const kParallelSegmentSize = 1 << 24
+
+// kReadWords is the number of words read from an input at once.
+const kReadWords = 4096
+
+// BuildParallel returns a new RSDic at path representing the first nbits bits of src,
+// an uncompressed bit vector stored as little-endian 64-bit words
+// (the same layout as DecodeAll). The result is returned with its writer closed
+// and its reader loaded.
+//
+// The bit vector is split into segments aligned to large blocks, which are
+// encoded concurrently by workers (GOMAXPROCS if workers <= 0) into temporary
+// RSDics under path. They are then stitched by Concat, which copies the codes
+// a word at a time and appends the large blocks and runs with their pointers and
+// ranks shifted (See appendLargeBlocks), so that the result is identical to the
+// one built sequentially by PushBack. Only the last large block of each segment
+// is appended small block by small block.
+func BuildParallel(path string, src io.ReaderAt, nbits uint64, workers int) (*RSDic, error) {
+	return BuildParallelContext(context.Background(), path, src, nbits, workers)
+}
+
+// BuildParallelContext is BuildParallel with cancellation and progress
+// (See context.go); the progress is reported as the segments are encoded.
+func BuildParallelContext(ctx context.Context, path string, src io.ReaderAt, nbits uint64, workers int) (rs *RSDic, err error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	segmentSize := floor(floor(nbits, uint64(workers)), kLargeBlockSize) * kLargeBlockSize
+	segmentSize = max(min(segmentSize, kParallelSegmentSize), kLargeBlockSize)
+	segmentNum := floor(nbits, segmentSize)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+	// the directory is removed on errors if created here (See removeOutput)
+	err = os.Mkdir(path, 0777)
+	if err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	created := err == nil
+	defer func() {
+		if err != nil && created {
+			os.Remove(path)
+		}
+	}()
+	tmpDir, err := os.MkdirTemp(path, "segments-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// a failed segment cancels the others, which stop at their next large block
+	segmentCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	t := newTracker(segmentCtx, nbits)
+	segments := make([]*RSDic, segmentNum)
+	errs := make([]error, segmentNum)
+	indices := make(chan uint64)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				start := i * segmentSize
+				segments[i], errs[i] = buildSegment(t, tmpDir, i, src, start, min(segmentSize, nbits-start))
+				if errs[i] != nil {
+					cancel()
+				}
+			}
+		}()
+	}
+dispatch:
+	for i := uint64(0); i < segmentNum; i++ {
+		select {
+		case indices <- i:
+		case <-segmentCtx.Done():
+			break dispatch
+		}
+	}
+	close(indices)
+	wg.Wait()
+	defer func() {
+		for _, segment := range segments {
+			if segment != nil {
+				segment.CloseReader()
+			}
+		}
+	}()
+	// the error of the failed segment rather than those of the cancelled ones
+	for _, segmentErr := range errs {
+		if segmentErr != nil && (err == nil || err == context.Canceled) {
+			err = segmentErr
+		}
+	}
+	if err == nil {
+		err = segmentCtx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the progress is reported for the segments, and Concat only checks for cancellation
+	return concat(&tracker{ctx: ctx}, path, segments)
+}
+
+// BuildFromReader returns a new RSDic at path representing the first nbits bits read from r,
+// an uncompressed bit vector stored as little-endian 64-bit words
+// (the same layout as DecodeAll). The words are encoded as they are read,
+// so that the memory used does not depend on nbits. The result is returned
+// with its writer closed and its reader loaded.
+func BuildFromReader(path string, r io.Reader, nbits uint64) (*RSDic, error) {
+	return BuildFromReaderContext(context.Background(), path, r, nbits)
+}
+
+// BuildFromReaderContext is BuildFromReader with cancellation and progress (See context.go).
+func BuildFromReaderContext(ctx context.Context, path string, r io.Reader, nbits uint64) (*RSDic, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+	rs, err := newOpOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	err = readWords(newTracker(ctx, nbits), r, nbits, func(word uint64, n uint64) { rs.pushWord(word, n) })
+	if err != nil {
+		removeOutput(rs)
+		return nil, err
+	}
+	if err := closeOpOutput(rs); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// BuildFromFile returns a new RSDic at path representing all bits of the file
+// filename in the layout of BuildFromReader (i.e. 8 bits per byte of the file).
+func BuildFromFile(path string, filename string) (*RSDic, error) {
+	return BuildFromFileContext(context.Background(), path, filename)
+}
+
+// BuildFromFileContext is BuildFromFile with cancellation and progress (See context.go).
+func BuildFromFileContext(ctx context.Context, path string, filename string) (*RSDic, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return BuildFromReaderContext(ctx, path, bufio.NewReader(f), uint64(info.Size())*8)
+}
+
+func buildSegment(t *tracker, tmpDir string, i uint64, src io.ReaderAt, start uint64, nbits uint64) (*RSDic, error) {
+	segment, err := newOpOutput(path.Join(tmpDir, fmt.Sprintf("%d", i)))
+	if err != nil {
+		return nil, err
+	}
+	err = readWords(t, io.NewSectionReader(src, int64(start/8), int64(floor(nbits, 8))), nbits,
+		func(word uint64, n uint64) { segment.pushWord(word, n) })
+	if err != nil {
+		removeOutput(segment)
+		return nil, err
+	}
+	if err := closeOpOutput(segment); err != nil {
+		return nil, err
+	}
+	return segment, nil
+}
+
+// readWords reads nbits bits stored as little-endian 64-bit words from r,
+// and calls push for each word with the number of its bits to use.
+// A short last word may be stored in less than 8 bytes.
+func readWords(t *tracker, r io.Reader, nbits uint64, push func(word uint64, n uint64)) error {
+	buf := make([]byte, kReadWords*8)
+	for pos := uint64(0); pos < nbits; {
+		size := min(uint64(len(buf)), floor(nbits-pos, 8))
+		chunk := buf[:size]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return err
+		}
+		for len(chunk) > 0 {
+			var word [8]byte
+			n := copy(word[:], chunk)
+			chunk = chunk[n:]
+			bitNum := min(kSmallBlockSize, nbits-pos)
+			push(binary.LittleEndian.Uint64(word[:]), bitNum)
+			pos += bitNum
+			if err := t.add(bitNum); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package rsdic
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// CacheStats reports the effectiveness of the decoded block cache.
+type CacheStats struct {
+	Hits     uint64 // number of lookups answered from the cache
+	Misses   uint64 // number of lookups that required decoding
+	Size     int    // number of cached small blocks
+	Capacity int    // maximum number of cached small blocks
+}
+
+// blockCache is a size-bounded LRU cache of decoded small blocks
+// keyed by small-block index. It is safe for concurrent use.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[uint64]*list.Element
+	order    *list.List // front is the most recently used
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+}
+
+type cacheEntry struct {
+	sblock uint64
+	word   uint64
+}
+
+func newBlockCache(capacity int) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		entries:  make(map[uint64]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+func (c *blockCache) get(sblock uint64) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[sblock]
+	if !ok {
+		c.misses.Add(1)
+		return 0, false
+	}
+	c.hits.Add(1)
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).word, true
+}
+
+func (c *blockCache) add(sblock uint64, word uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[sblock]; ok {
+		elem.Value.(*cacheEntry).word = word
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).sblock)
+	}
+	c.entries[sblock] = c.order.PushFront(&cacheEntry{sblock: sblock, word: word})
+}
+
+func (c *blockCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[uint64]*list.Element, c.capacity)
+	c.order.Init()
+}
+
+func (c *blockCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:     c.hits.Load(),
+		Misses:   c.misses.Load(),
+		Size:     c.order.Len(),
+		Capacity: c.capacity,
+	}
+}
+
+// SetBlockCache enables a cache of up to size decoded small blocks (64 bits each),
+// which is consulted by Bit, Rank, Select and BitAndRank.
+// A size of 0 disables the cache.
+func (rs *RSDic) SetBlockCache(size int) {
+	if size <= 0 {
+		rs.cache = nil
+		return
+	}
+	rs.cache = newBlockCache(size)
+}
+
+// BlockCacheStats returns the hit and miss counters of the cache set by SetBlockCache.
+func (rs RSDic) BlockCacheStats() CacheStats {
+	if rs.cache == nil {
+		return CacheStats{}
+	}
+	return rs.cache.stats()
+}
+
+// cachedBlock returns the decoded bits of the small block sblock,
+// whose code starts at pointer, using the cache.
+func (rs RSDic) cachedBlock(sblock uint64, rankSB uint8, pointer uint64) uint64 {
+	if word, ok := rs.cache.get(sblock); ok {
+		return word
+	}
+	code := getSliceBuffer(rs.reader.bitsReader, rs.bits, pointer, kEnumCodeLength[rankSB])
+	word := enumDecode(code, rankSB)
+	rs.cache.add(sblock, word)
+	return word
+}
@@ -0,0 +1,163 @@
+package rsdic
+
+import "context"
+
+// Concat returns a new RSDic at outPath representing the concatenation of parts.
+// The result is the same as pushing back all bits of parts in order,
+// and is returned with its writer closed and its reader loaded.
+//
+// While the result ends at a large block boundary, the completed large blocks
+// of a part without updates by Set are stitched (See appendLargeBlocks): its
+// codes are copied a word at a time, and its large blocks and runs are
+// appended with their pointers and ranks shifted. While the result ends at
+// a small block boundary, the small blocks of a part are copied as their codes
+// without decoding and re-encoding them; only the last small block of the
+// part, which is kept decoded, is decoded. Otherwise, the small blocks are
+// decoded and appended shifted.
+func Concat(outPath string, parts ...*RSDic) (*RSDic, error) {
+	return ConcatContext(context.Background(), outPath, parts...)
+}
+
+// ConcatContext is Concat with cancellation and progress (See context.go).
+func ConcatContext(ctx context.Context, outPath string, parts ...*RSDic) (*RSDic, error) {
+	total := uint64(0)
+	for _, part := range parts {
+		total += part.num
+	}
+	return concat(newTracker(ctx, total), outPath, parts)
+}
+
+func concat(t *tracker, outPath string, parts []*RSDic) (*RSDic, error) {
+	out, err := newOpOutput(outPath, parts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := concatParts(t, out, parts); err != nil {
+		removeOutput(out)
+		return nil, err
+	}
+	if err := closeOpOutput(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func concatParts(t *tracker, out *RSDic, parts []*RSDic) error {
+	for _, part := range parts {
+		if part.num == 0 {
+			continue
+		}
+		wr := part.newWordReader(0)
+		blockNum := floor(part.num, kSmallBlockSize)
+		if out.num%kSmallBlockSize != 0 {
+			for i := uint64(0); i < blockNum; i++ {
+				n := min(kSmallBlockSize, part.num-i*kSmallBlockSize)
+				out.pushWord(wr.next(), n)
+				if err := t.add(n); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		out.writeBlock()
+		start := uint64(0)
+		if out.num%kLargeBlockSize == 0 && !part.updated() && !part.legacy {
+			if err := out.appendLargeBlocks(t, part); err != nil {
+				return err
+			}
+			start = (part.rankBlockLength - 1) * kSmallBlockPerLargeBlock
+			wr = part.newWordReader(start)
+		}
+		for i := start; i+1 < blockNum; i++ {
+			out.pushCode(wr.nextCode())
+			if err := t.add(kSmallBlockSize); err != nil {
+				return err
+			}
+		}
+		n := part.num - (blockNum-1)*kSmallBlockSize
+		out.pushLastBits(wr.next(), n)
+		if err := t.add(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendLargeBlocks appends the completed large blocks of part (those before its
+// last one), which has no updates, to out, which is at the start of a large block
+// without small blocks (i.e. after writeBlock at a large block boundary).
+//
+// The codes of part are appended a word at a time, and each dense large block
+// of part is appended with its pointer and rank shifted; the select samples are
+// written anew from the ranks, as they depend on the ranks before part. Each run
+// of part is appended at once, extending the last run of out if it has the same bit.
+// Thus it takes time proportional to the codes and the dense large blocks of part,
+// rather than to its small blocks.
+func (out *RSDic) appendLargeBlocks(t *tracker, part *RSDic) error {
+	blockNum := part.rankBlockLength - 1
+	if blockNum == 0 {
+		return nil
+	}
+	codeBase, rankBase := out.codeLen, out.oneNum
+	for i := uint64(0); i*kSmallBlockSize < part.pendPointer; i++ {
+		n := min(kSmallBlockSize, part.pendPointer-i*kSmallBlockSize)
+		word := part.bitsWord(i)
+		if n < kSmallBlockSize {
+			word &= 1<<n - 1
+		}
+		out.appendBits(word, uint8(n))
+	}
+	for lb := part.lblockAt(0); lb.index < blockNum; lb = part.nextLBlock(lb) {
+		index := out.rankBlockLength - 1
+		n := lb.end - lb.index
+		oneNum := uint64(0)
+		if lb.run {
+			if lb.bit {
+				oneNum = n * kLargeBlockSize
+			}
+			if !out.hasOpenRun || out.openRun.bit != lb.bit {
+				out.flushOpenRun()
+				out.openRun = runBlock{
+					start:       index,
+					end:         index,
+					bit:         lb.bit,
+					rank:        out.oneNum,
+					phys:        out.denseBlockLength,
+					oneSamples:  floor(out.oneNum, kSelectBlockSize) - out.selectOneLength,
+					zeroSamples: floor(out.zeroNum, kSelectBlockSize) - out.selectZeroLength,
+				}
+				out.hasOpenRun = true
+			}
+			out.openRun.end += n
+		} else {
+			out.flushOpenRun()
+			appendUint64(out.writer.rankWriter, lb.rank+rankBase)
+			appendUint64(out.writer.pointerWriter, lb.pointer+codeBase)
+			for i := uint64(0); i < kSmallBlockPerLargeBlock; i++ {
+				rankSB := part.smallRank(lb, i)
+				appendUint8(out.writer.rankSmallWriter, rankSB)
+				oneNum += uint64(rankSB)
+			}
+			if hasSample(out.oneNum, out.oneNum+oneNum) {
+				appendUint64(out.writer.selectOneWriter, index)
+				out.selectOneLength++
+			}
+			if hasSample(out.zeroNum, out.zeroNum+kLargeBlockSize-oneNum) {
+				appendUint64(out.writer.selectZeroWriter, index)
+				out.selectZeroLength++
+			}
+			out.denseBlockLength++
+		}
+		out.num += n * kLargeBlockSize
+		out.oneNum += oneNum
+		out.zeroNum += n*kLargeBlockSize - oneNum
+		out.rankBlockLength += n
+		out.rankSmBlockLength += n * kSmallBlockPerLargeBlock
+		out.pendRank = out.oneNum
+		if err := t.add(n * kLargeBlockSize); err != nil {
+			return err
+		}
+	}
+	out.pendPointer = out.codeLen
+	return nil
+}
@@ -0,0 +1,184 @@
+package rsdic
+
+import (
+	"io"
+	"sync"
+)
+
+// Concurrency model
+//
+// The queries of RSDic (Num, OneNum, ZeroNum, Bit, Rank, Select, Select1,
+// Select0, BitAndRank, Stats, AllocSize, BlockCacheStats, MarshalBinary) and
+// the functions reading RSDics (And, AndCount, Concat, ...) don't modify it,
+// and the block cache set by SetBlockCache is locked internally. Thus any
+// number of goroutines may query an RSDic concurrently, as long as no goroutine
+// modifies it at the same time (PushBack, Set, Truncate, LoadReader, LoadWriter,
+// CloseWriter, SetBlockCache, UnmarshalBinary).
+//
+// To query an RSDic while it is growing, wrap it by NewConcurrent.
+
+// Concurrent is a single-writer/multi-reader mode of an RSDic.
+//
+// Modifications (PushBack, Set, Truncate) hold a write lock, and queries hold
+// a read lock, so that queries see num, the last small block and the write
+// buffer consistently. Since PushBack appends to the files after the reader is
+// mapped, a query first reloads the reader (under the write lock) if any file
+// has grown past its mapped length, which happens at most once per small block
+// pushed back between queries.
+//
+// The wrapped RSDic must not be used directly while it is wrapped.
+// Concurrent is safe for concurrent use; modifications are serialized.
+type Concurrent struct {
+	mu    sync.RWMutex
+	rs    *RSDic
+	stale bool // whether the reader may miss data appended to the files
+}
+
+// NewConcurrent returns a Concurrent wrapping rs, whose writer must be loaded
+// before PushBack is called.
+func NewConcurrent(rs *RSDic) *Concurrent {
+	return &Concurrent{rs: rs, stale: true}
+}
+
+// PushBack appends the bit to the end of B
+func (c *Concurrent) PushBack(bit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rs.PushBack(bit)
+	if !c.stale {
+		c.stale = c.rs.readerStale()
+	}
+}
+
+// Set sets B[pos] to bit (See RSDic.Set).
+func (c *Concurrent) Set(pos uint64, bit bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rs.Set(pos, bit)
+}
+
+// Truncate drops the bits after the first newNum bits of B (See RSDic.Truncate).
+func (c *Concurrent) Truncate(newNum uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stale = true
+	if err := c.rs.Truncate(newNum); err != nil {
+		return err
+	}
+	c.stale = false
+	return nil
+}
+
+// View calls f with the wrapped RSDic under the read lock, with the reader
+// covering all the bits pushed back so far. f must not modify rs nor keep it
+// after returning.
+func (c *Concurrent) View(f func(rs *RSDic)) error {
+	if err := c.rLock(); err != nil {
+		return err
+	}
+	defer c.mu.RUnlock()
+	f(c.rs)
+	return nil
+}
+
+// rLock takes the read lock after reloading the reader if it is stale.
+func (c *Concurrent) rLock() error {
+	for {
+		c.mu.RLock()
+		if !c.stale {
+			return nil
+		}
+		c.mu.RUnlock()
+		c.mu.Lock()
+		// a PushBack may have come in between the locks
+		if c.stale && c.rs.readerStale() {
+			if err := c.rs.reloadFiles(); err != nil {
+				c.mu.Unlock()
+				return err
+			}
+		}
+		c.stale = false
+		c.mu.Unlock()
+	}
+}
+
+// query runs f under the read lock, and panics if the reader can't be reloaded
+// (as the queries of RSDic panic on read errors).
+func (c *Concurrent) query(f func(rs *RSDic)) {
+	if err := c.View(f); err != nil {
+		panic(err)
+	}
+}
+
+// Num returns the number of bits
+func (c *Concurrent) Num() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rs.num
+}
+
+// OneNum returns the number of ones in bits
+func (c *Concurrent) OneNum() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rs.OneNum()
+}
+
+// ZeroNum returns the number of zeros in bits
+func (c *Concurrent) ZeroNum() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rs.ZeroNum()
+}
+
+// Bit returns the (pos+1)-th bit in bits, i.e. bits[pos]
+func (c *Concurrent) Bit(pos uint64) (bit bool) {
+	c.query(func(rs *RSDic) { bit = rs.Bit(pos) })
+	return
+}
+
+// Rank returns the number of bit's in B[0...pos)
+func (c *Concurrent) Rank(pos uint64, bit bool) (rank uint64) {
+	c.query(func(rs *RSDic) { rank = rs.Rank(pos, bit) })
+	return
+}
+
+// Select returns the position of (rank+1)-th occurence of bit in B
+// Select returns num if rank+1 is larger than the possible range.
+func (c *Concurrent) Select(rank uint64, bit bool) (pos uint64) {
+	c.query(func(rs *RSDic) { pos = rs.Select(rank, bit) })
+	return
+}
+
+// BitAndRank returns the (pos+1)-th bit (=b) and Rank(pos, b)
+func (c *Concurrent) BitAndRank(pos uint64) (bit bool, rank uint64) {
+	c.query(func(rs *RSDic) { bit, rank = rs.BitAndRank(pos) })
+	return
+}
+
+// readerStale returns whether the reader is missing or any file has been
+// written past its mapped length.
+func (rs *RSDic) readerStale() bool {
+	if rs.reader == nil {
+		return true
+	}
+	lengths := []struct {
+		reader io.ReaderAt
+		length uint64
+	}{
+		{rs.reader.bitsReader, rs.bits.numWritten * 8},
+		{rs.reader.pointerReader, rs.denseBlockLength * 8},
+		{rs.reader.rankReader, rs.denseBlockLength * 8},
+		{rs.reader.rankSmallReader, rs.denseBlockLength * kSmallBlockPerLargeBlock},
+		{rs.reader.runReader, rs.runBlockLength * kRunBlockWords * 8},
+		{rs.reader.selectOneReader, rs.selectOneLength * 8},
+		{rs.reader.selectZeroReader, rs.selectZeroLength * 8},
+	}
+	for _, l := range lengths {
+		r, ok := l.reader.(interface{ Len() int })
+		if !ok || uint64(r.Len()) < l.length {
+			return true
+		}
+	}
+	return false
+}
@@ -4,6 +4,10 @@ const (
 	kSmallBlockSize          = 64
 	kLargeBlockSize          = 1024
 	kSelectBlockSize         = 4096
-	kUseRawLen               = 48
+	kUseRawLen               = 48 // small blocks whose code would take kUseRawLen bits or more are stored raw
 	kSmallBlockPerLargeBlock = kLargeBlockSize / kSmallBlockSize
+
+	// kFormatVersion is the version of the layout of the files and the metadata.
+	// Version 0 (without the version in the metadata) has no runs (See lblock.go).
+	kFormatVersion = 1
 )
@@ -0,0 +1,80 @@
+package rsdic
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+)
+
+// Cancellation and progress
+//
+// The bulk functions (the builders, Concat, the logical operations and their
+// counts, and DecodeAll) have variants taking a context, e.g. AndContext,
+// which check ctx.Done() between large blocks and return ctx.Err() when it is
+// done. A function building an RSDic then removes the files it has written,
+// and the directory if it created it. The iterators of EliasFano and
+// SparseArray made by IteratorContext stop likewise, after which their Err
+// returns ctx.Err().
+// A progress callback attached to the context by WithProgress is called at
+// the same points with the number of bits processed so far.
+
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx with the progress callback f, which the
+// variants taking a context call between large blocks with the number of bits
+// processed so far (done) and to be processed (total). The calls are
+// serialized and done increases with each call.
+func WithProgress(ctx context.Context, f func(done uint64, total uint64)) context.Context {
+	return context.WithValue(ctx, progressKey{}, f)
+}
+
+// tracker counts the bits processed by a bulk function, which may be shared
+// by goroutines, and checks for cancellation between large blocks.
+type tracker struct {
+	ctx      context.Context
+	progress func(done uint64, total uint64)
+	total    uint64
+	done     atomic.Uint64
+	mu       sync.Mutex // serializes the calls of progress
+	reported uint64
+}
+
+func newTracker(ctx context.Context, total uint64) *tracker {
+	progress, _ := ctx.Value(progressKey{}).(func(done uint64, total uint64))
+	return &tracker{ctx: ctx, progress: progress, total: total}
+}
+
+// add records n more bits processed. When a large block boundary is crossed
+// (or all bits are processed), it reports the progress and returns
+// the error of the context.
+func (t *tracker) add(n uint64) error {
+	done := t.done.Add(n)
+	if done/kLargeBlockSize == (done-n)/kLargeBlockSize && done != t.total {
+		return nil
+	}
+	if t.progress != nil {
+		t.mu.Lock()
+		if done > t.reported {
+			t.reported = done
+			t.progress(done, t.total)
+		}
+		t.mu.Unlock()
+	}
+	return t.ctx.Err()
+}
+
+// removeOutput closes an RSDic being built and removes its files,
+// and its directory if New created it.
+func removeOutput(out *RSDic) {
+	out.CloseWriter()
+	out.CloseReader()
+	for _, name := range []string{BITS_FN, POINTER_BLOCK_FN, RANK_BLOCK_FN, SELECT_ONE_IND_FN,
+		SELECT_ZERO_IND_FN, RANK_SMALL_BLOCK_FN, RUN_BLOCK_FN} {
+		os.Remove(path.Join(out.path, name))
+	}
+	if out.created {
+		os.Remove(out.path)
+	}
+}
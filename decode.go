@@ -0,0 +1,229 @@
+package rsdic
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// wordReader decodes consecutive small blocks starting from a given one.
+// It keeps the running code pointer, so that each block is decoded
+// without rescanning the small blocks of its large block.
+// The bits updated by Set are merged into the decoded blocks.
+type wordReader struct {
+	rs       *RSDic
+	sblock   uint64
+	lb       lblock
+	pointer  uint64
+	storedSB uint8    // the number of ones stored for the current small block (set by rank)
+	sets     []uint64 // the updates from the current small block
+	clears   []uint64
+}
+
+func (rs *RSDic) newWordReader(sblock uint64) *wordReader {
+	wr := &wordReader{rs: rs, sblock: sblock, sets: rs.sets, clears: rs.clears}
+	if sblock >= rs.rankSmBlockLength {
+		return wr
+	}
+	wr.lb = rs.lblockAt(sblock / kSmallBlockPerLargeBlock)
+	if !wr.lb.run {
+		wr.pointer = wr.lb.pointer
+		for i := uint64(0); i < sblock%kSmallBlockPerLargeBlock; i++ {
+			wr.pointer += uint64(kEnumCodeLength[rs.smallRank(wr.lb, i)])
+		}
+	}
+	return wr
+}
+
+// rank returns the number of ones in the current small block,
+// which must be called before skip, decode and runLeft.
+// Blocks after the last one have no ones.
+func (wr *wordReader) rank() uint8 {
+	wr.storedSB = wr.storedRank()
+	if len(wr.sets) == 0 && len(wr.clears) == 0 {
+		return wr.storedSB
+	}
+	start := wr.sblock * kSmallBlockSize
+	wr.sets = wr.sets[countLess(wr.sets, start):]
+	wr.clears = wr.clears[countLess(wr.clears, start):]
+	end := start + kSmallBlockSize
+	return wr.storedSB + uint8(countLess(wr.sets, end)) - uint8(countLess(wr.clears, end))
+}
+
+// updatedBlock returns whether the current small block has updates.
+func (wr *wordReader) updatedBlock() bool {
+	end := (wr.sblock + 1) * kSmallBlockSize
+	return (len(wr.sets) > 0 && wr.sets[0] < end) || (len(wr.clears) > 0 && wr.clears[0] < end)
+}
+
+// storedRank returns the number of ones stored for the current small block.
+func (wr *wordReader) storedRank() uint8 {
+	rs := wr.rs
+	if wr.sblock > rs.rankSmBlockLength {
+		return 0
+	} else if wr.sblock == rs.rankSmBlockLength {
+		return popCount(rs.lastBlock)
+	}
+	if wr.sblock >= wr.lb.end*kSmallBlockPerLargeBlock {
+		wr.lb = rs.nextLBlock(wr.lb)
+		wr.pointer = wr.lb.pointer
+	}
+	if wr.lb.run {
+		if wr.lb.bit {
+			return kSmallBlockSize
+		}
+		return 0
+	}
+	return rs.smallRank(wr.lb, wr.sblock%kSmallBlockPerLargeBlock)
+}
+
+// skip moves to the next small block without decoding the current one.
+func (wr *wordReader) skip() {
+	if wr.sblock < wr.rs.rankSmBlockLength && !wr.lb.run {
+		wr.pointer += uint64(kEnumCodeLength[wr.storedSB])
+	}
+	wr.sblock++
+}
+
+// runLeft returns the number of small blocks left in the run containing the current
+// small block before the next update, or 0 if it is not in a run.
+func (wr *wordReader) runLeft() uint64 {
+	if wr.sblock >= wr.rs.rankSmBlockLength || !wr.lb.run {
+		return 0
+	}
+	end := wr.lb.end * kSmallBlockPerLargeBlock
+	if len(wr.sets) > 0 {
+		end = min(end, wr.sets[0]/kSmallBlockSize)
+	}
+	if len(wr.clears) > 0 {
+		end = min(end, wr.clears[0]/kSmallBlockSize)
+	}
+	return end - wr.sblock
+}
+
+// skipRun moves n small blocks ahead within the current run.
+func (wr *wordReader) skipRun(n uint64) {
+	wr.sblock += n
+}
+
+// decode returns the decoded bits of the current small block and moves to the next one.
+// Blocks after the last one are returned as zeros.
+func (wr *wordReader) decode() uint64 {
+	rs := wr.rs
+	rankSB := wr.storedSB
+	word := uint64(0)
+	switch {
+	case wr.sblock > rs.rankSmBlockLength:
+	case wr.sblock == rs.rankSmBlockLength:
+		word = rs.lastBlock
+	case rankSB == 0:
+	case rankSB == kSmallBlockSize:
+		word = ^uint64(0)
+	default:
+		code := getSliceBuffer(rs.reader.bitsReader, rs.bits, wr.pointer, kEnumCodeLength[rankSB])
+		word = enumDecode(code, rankSB)
+	}
+	end := (wr.sblock + 1) * kSmallBlockSize
+	for ; len(wr.sets) > 0 && wr.sets[0] < end; wr.sets = wr.sets[1:] {
+		word |= 1 << (wr.sets[0] % kSmallBlockSize)
+	}
+	for ; len(wr.clears) > 0 && wr.clears[0] < end; wr.clears = wr.clears[1:] {
+		word &^= 1 << (wr.clears[0] % kSmallBlockSize)
+	}
+	wr.skip()
+	return word
+}
+
+// nextCode returns the number of ones and the code of the current small block,
+// and moves to the next one. The code of the last small block is encoded from it.
+func (wr *wordReader) nextCode() (uint8, uint64) {
+	rs := wr.rs
+	rankSB := wr.rank()
+	if wr.updatedBlock() {
+		return rankSB, enumEncode(wr.decode(), rankSB)
+	}
+	code := uint64(0)
+	switch {
+	case wr.sblock > rs.rankSmBlockLength:
+	case wr.sblock == rs.rankSmBlockLength:
+		code = enumEncode(rs.lastBlock, rankSB)
+	case wr.lb.run:
+	default:
+		code = getSliceBuffer(rs.reader.bitsReader, rs.bits, wr.pointer, kEnumCodeLength[rankSB])
+	}
+	wr.skip()
+	return rankSB, code
+}
+
+// next returns the decoded bits of the current small block and moves to the next one.
+func (wr *wordReader) next() uint64 {
+	wr.rank()
+	return wr.decode()
+}
+
+// GetWords appends B[start...start+nbits) to dst as little-endian 64-bit words
+// and returns the extended slice, i.e. B[start+i] is stored in bit i%64 of
+// the (i/64)-th appended word. Bits after the end of the range are zero.
+func (rs RSDic) GetWords(start uint64, nbits uint64, dst []uint64) []uint64 {
+	if start+nbits > rs.num {
+		panic(fmt.Sprintf("GetWords: range [%d, %d) is out of bounds (num = %d)", start, start+nbits, rs.num))
+	}
+	if nbits == 0 {
+		return dst
+	}
+	wr := rs.newWordReader(start / kSmallBlockSize)
+	offset := start % kSmallBlockSize
+	cur := wr.next()
+	for remain := nbits; remain > 0; {
+		word := cur >> offset
+		if offset+remain > kSmallBlockSize {
+			cur = wr.next()
+			if offset > 0 {
+				word |= cur << (kSmallBlockSize - offset)
+			}
+		}
+		if remain < kSmallBlockSize {
+			word &= (1 << remain) - 1
+			remain = 0
+		} else {
+			remain -= kSmallBlockSize
+		}
+		dst = append(dst, word)
+	}
+	return dst
+}
+
+// DecodeAll writes the whole uncompressed bit vector B to w
+// as little-endian 64-bit words (the same layout as GetWords).
+func (rs RSDic) DecodeAll(w io.Writer) error {
+	return rs.DecodeAllContext(context.Background(), w)
+}
+
+// DecodeAllContext is DecodeAll with cancellation and progress (See context.go).
+// The words written before cancellation are left in w.
+func (rs RSDic) DecodeAllContext(ctx context.Context, w io.Writer) error {
+	const bufWords = 4096
+	buf := make([]byte, 0, bufWords*8)
+	t := newTracker(ctx, rs.num)
+	wr := rs.newWordReader(0)
+	wordNum := floor(rs.num, kSmallBlockSize)
+	for i := uint64(0); i < wordNum; i++ {
+		buf = binary.LittleEndian.AppendUint64(buf, wr.next())
+		if err := t.add(min(kSmallBlockSize, rs.num-i*kSmallBlockSize)); err != nil {
+			return err
+		}
+		if len(buf) == cap(buf) {
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+	}
+	if len(buf) > 0 {
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+package rsdic
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Delta is an overlay of updated bits on a read-only RSDic (the base).
+//
+// Updates by Set are appended to a write-ahead log file, and kept in memory
+// as the updates of a copy of the base (the view), as RSDic.Set keeps them
+// (See set.go), so that Bit, Rank and Select of the view return the merged bits.
+// Compact rebuilds the base from the base and the updates into a new directory,
+// and swaps it in. A log record holds a position and the bit set there
+// (not a flip), so that replaying the log on the base before or after a
+// compaction gives the same view. Thus Compact can switch the base durably
+// before it drops the compacted records from the log: the new base is named
+// in the file logPath+".base", from which OpenDelta loads it.
+//
+// Delta is safe for concurrent use.
+type Delta struct {
+	mu      sync.RWMutex
+	base    *RSDic
+	view    RSDic // base with the updates
+	logPath string
+	log     *os.File
+
+	compactMu  sync.Mutex
+	compacting bool
+	recent     []uint64 // records logged during the compaction
+}
+
+// deltaBase is the content of logPath+".base", which names the base made by
+// the last compaction.
+type deltaBase struct {
+	Path string
+	Meta []byte // MarshalBinary of the base
+}
+
+func deltaBasePath(logPath string) string {
+	return logPath + ".base"
+}
+
+// OpenDelta returns a Delta on base whose updates are logged to logPath.
+// If a compaction has switched to another base, that base is loaded instead,
+// which the caller should close by Base().CloseReader() as base.
+// The updates already in the log are replayed, and a last record only partly
+// written (at a crash) is cut off.
+func OpenDelta(base *RSDic, logPath string) (*Delta, error) {
+	base, loaded, err := loadDeltaBase(base, logPath)
+	if err != nil {
+		return nil, err
+	}
+	d, err := openDelta(base, logPath)
+	if err != nil && loaded {
+		base.CloseReader()
+	}
+	return d, err
+}
+
+// loadDeltaBase returns the base named by the last compaction if it is not base,
+// and whether it is loaded.
+func loadDeltaBase(base *RSDic, logPath string) (*RSDic, bool, error) {
+	in, err := os.ReadFile(deltaBasePath(logPath))
+	if os.IsNotExist(err) {
+		return base, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	var db deltaBase
+	var bh codec.MsgpackHandle
+	if err := codec.NewDecoderBytes(in, &bh).Decode(&db); err != nil {
+		return nil, false, err
+	}
+	if path.Clean(db.Path) == path.Clean(base.path) {
+		return base, false, nil
+	}
+	compacted, err := New(db.Path)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := compacted.UnmarshalBinary(db.Meta); err != nil {
+		return nil, false, err
+	}
+	if err := compacted.LoadReader(); err != nil {
+		return nil, false, err
+	}
+	return compacted, true, nil
+}
+
+func openDelta(base *RSDic, logPath string) (*Delta, error) {
+	log, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	d := &Delta{base: base, view: *base, logPath: logPath, log: log}
+	r := bufio.NewReader(log)
+	buf := make([]byte, 8)
+	for size := int64(0); ; size += 8 {
+		if _, err := io.ReadFull(r, buf); err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			// a record partly written at a crash, which was never applied
+			if err := log.Truncate(size); err != nil {
+				log.Close()
+				return nil, err
+			}
+			break
+		} else if err != nil {
+			log.Close()
+			return nil, err
+		}
+		pos, bit := decodeDeltaRecord(binary.LittleEndian.Uint64(buf))
+		if pos >= base.num {
+			log.Close()
+			return nil, fmt.Errorf("rsdic: delta log %s has position %d out of bounds (num = %d)", logPath, pos, base.num)
+		}
+		d.view.update(pos, bit)
+	}
+	return d, nil
+}
+
+func encodeDeltaRecord(pos uint64, bit bool) uint64 {
+	if bit {
+		return pos<<1 | 1
+	}
+	return pos << 1
+}
+
+func decodeDeltaRecord(record uint64) (uint64, bool) {
+	return record >> 1, record&1 == 1
+}
+
+// Close closes the log file.
+func (d *Delta) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.log.Close()
+}
+
+// Sync commits the logged updates to stable storage.
+func (d *Delta) Sync() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.log.Sync()
+}
+
+// Base returns the current base, which is replaced by Compact.
+func (d *Delta) Base() *RSDic {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.base
+}
+
+// Len returns the number of bits differing from the files of the base,
+// i.e. those updated through d (and by Set on the base, if any).
+func (d *Delta) Len() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.view.sets) + len(d.view.clears)
+}
+
+// Set sets B[pos] to bit, logging it before it is applied.
+func (d *Delta) Set(pos uint64, bit bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if pos >= d.base.num {
+		return fmt.Errorf("rsdic: Delta.Set: position %d is out of bounds (num = %d)", pos, d.base.num)
+	}
+	record := encodeDeltaRecord(pos, bit)
+	if err := writeRecords(d.log, []uint64{record}); err != nil {
+		return err
+	}
+	d.view.update(pos, bit)
+	if d.compacting {
+		d.recent = append(d.recent, record)
+	}
+	return nil
+}
+
+// Num returns the number of bits
+func (d *Delta) Num() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.view.Num()
+}
+
+// OneNum returns the number of ones in bits
+func (d *Delta) OneNum() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.view.OneNum()
+}
+
+// ZeroNum returns the number of zeros in bits
+func (d *Delta) ZeroNum() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.view.ZeroNum()
+}
+
+// Bit returns the (pos+1)-th bit in bits, i.e. bits[pos]
+func (d *Delta) Bit(pos uint64) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.view.Bit(pos)
+}
+
+// Rank returns the number of bit's in B[0...pos)
+func (d *Delta) Rank(pos uint64, bit bool) uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.view.Rank(pos, bit)
+}
+
+// Select returns the position of (rank+1)-th occurence of bit in B
+// Select returns num if rank+1 is larger than the possible range.
+func (d *Delta) Select(rank uint64, bit bool) uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.view.Select(rank, bit)
+}
+
+// Compact builds a new base at path from the current base and the updates,
+// and swaps it in, after which the updates made during the compaction
+// remain in the log. The previous base and its directory are left to the caller.
+//
+// The new base is synced and named in logPath+".base" before the log is
+// rewritten, so that a crash at any point leaves the previous base with the
+// whole log or the new base with a log giving the same view. If the new base
+// is named but the log is not rewritten, the new base is used with the whole log,
+// and the error is returned. Otherwise the new base is removed on errors.
+//
+// The base is built, synced and named, and the new log written and synced,
+// without blocking Set and the queries; they are blocked only while the log
+// and the base are swapped, when the records logged since the new log was
+// written are appended to it.
+func (d *Delta) Compact(path string) error {
+	return d.CompactContext(context.Background(), path)
+}
+
+// CompactContext is Compact with cancellation and progress (See context.go),
+// which are checked while the new base is built.
+func (d *Delta) CompactContext(ctx context.Context, path string) error {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+
+	d.mu.Lock()
+	view := d.view // the updates are copied on write, so the copy keeps them as they are
+	d.compacting = true
+	d.recent = nil
+	d.mu.Unlock()
+
+	newBase, err := ConcatContext(ctx, path, &view)
+	if err == nil {
+		var switched bool
+		if switched, err = switchDeltaBase(d.logPath, newBase); !switched {
+			removeOutput(newBase)
+			newBase = nil
+		} else if err != nil {
+			err = fmt.Errorf("rsdic: Compact: %s may not be durable, so the log is kept whole: %w",
+				deltaBasePath(d.logPath), err)
+		}
+	}
+	var tmp *os.File
+	written := 0
+	if err == nil {
+		tmp, written, err = d.writeRecentLog()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.compacting = false
+	recent := d.recent
+	d.recent = nil
+	if newBase == nil {
+		return err
+	}
+	d.base = newBase
+	d.view = *newBase
+	for _, record := range recent {
+		d.view.update(decodeDeltaRecord(record))
+	}
+	if err != nil {
+		return err
+	}
+	return d.swapLog(tmp, recent[written:])
+}
+
+// switchDeltaBase syncs the files of base and atomically names it in logPath+".base",
+// and returns whether it is named.
+func switchDeltaBase(logPath string, base *RSDic) (bool, error) {
+	if err := syncFiles(base.path); err != nil {
+		return false, err
+	}
+	meta, err := base.MarshalBinary()
+	if err != nil {
+		return false, err
+	}
+	var out []byte
+	var bh codec.MsgpackHandle
+	if err := codec.NewEncoderBytes(&out, &bh).Encode(deltaBase{Path: base.path, Meta: meta}); err != nil {
+		return false, err
+	}
+	tmp, err := os.Create(deltaBasePath(logPath) + ".tmp")
+	if err != nil {
+		return false, err
+	}
+	renamed, err := replaceFile(tmp, out, deltaBasePath(logPath))
+	if renamed {
+		tmp.Close()
+	}
+	return renamed, err
+}
+
+// replaceFile writes data to the new file tmp, syncs it and renames it to name,
+// and returns whether it is renamed. If it fails before the rename,
+// tmp is closed and removed.
+func replaceFile(tmp *os.File, data []byte, name string) (bool, error) {
+	err := func() error {
+		if _, err := tmp.Write(data); err != nil {
+			return err
+		}
+		if err := tmp.Sync(); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), name)
+	}()
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return false, err
+	}
+	return true, syncDir(path.Dir(name))
+}
+
+// writeRecentLog writes the records logged during the compaction so far to a new
+// log file and syncs it, and returns it with the number of records written.
+func (d *Delta) writeRecentLog() (*os.File, int, error) {
+	d.mu.RLock()
+	recent := d.recent // the records are only appended
+	d.mu.RUnlock()
+	tmp, err := os.OpenFile(d.logPath+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := writeRecords(tmp, recent); err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+	return tmp, len(recent), nil
+}
+
+// swapLog appends records (those logged after writeRecentLog, which are few)
+// to the new log tmp, and atomically replaces the log with it.
+func (d *Delta) swapLog(tmp *os.File, records []uint64) error {
+	err := writeRecords(tmp, records)
+	if err == nil && len(records) > 0 {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.logPath)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	// the file opened for appending is the log from now on
+	d.log.Close()
+	d.log = tmp
+	return syncDir(path.Dir(d.logPath))
+}
+
+// writeRecords appends records to f.
+func writeRecords(f *os.File, records []uint64) error {
+	buf := make([]byte, 0, len(records)*8)
+	for _, record := range records {
+		buf = binary.LittleEndian.AppendUint64(buf, record)
+	}
+	_, err := f.Write(buf)
+	return err
+}
@@ -0,0 +1,170 @@
+package rsdic
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// checkDelta checks all bits, ranks and selects of d against orig.
+func checkDelta(d *Delta, orig []uint8) {
+	raw := newRawBitVector(orig)
+	So(d.Num(), ShouldEqual, raw.num)
+	So(d.OneNum(), ShouldEqual, raw.oneNum)
+	So(d.ZeroNum(), ShouldEqual, raw.num-raw.oneNum)
+	So(d.Rank(raw.num, true), ShouldEqual, raw.oneNum)
+	So(d.Select(raw.oneNum, true), ShouldEqual, raw.num)
+	for i := uint64(0); i < raw.num; i += 3 {
+		bit := d.Bit(i)
+		rank := d.Rank(i, bit)
+		if bit != (orig[i] == 1) || rank != bitNum(raw.ranks[i], i, bit) || d.Select(rank, bit) != i {
+			So(bit, ShouldEqual, orig[i] == 1)
+			So(rank, ShouldEqual, bitNum(raw.ranks[i], i, bit))
+			So(d.Select(rank, bit), ShouldEqual, i)
+		}
+	}
+}
+
+func TestDelta(t *testing.T) {
+	orig := runBits(4)
+	for i := 0; i < 2000; i++ {
+		orig = append(orig, uint8(rand.Intn(2)))
+	}
+	_, base := initBitVectorAt("test/base", orig)
+	defer base.CloseReader()
+	os.Remove("test/delta.log")
+	os.Remove("test/delta.log.base")
+
+	Convey("When bits are updated through a delta", t, func() {
+		d, err := OpenDelta(base, "test/delta.log")
+		So(err, ShouldBeNil)
+		for i := 0; i < 200; i++ {
+			pos := rand.Intn(len(orig))
+			bit := rand.Intn(2) == 1
+			So(d.Set(uint64(pos), bit), ShouldBeNil)
+			orig[pos] = 0
+			if bit {
+				orig[pos] = 1
+			}
+		}
+		So(d.Len(), ShouldBeGreaterThan, 0)
+		checkDelta(d, orig)
+		So(d.Set(uint64(len(orig)), true), ShouldNotBeNil)
+		So(d.Close(), ShouldBeNil)
+
+		d, err = OpenDelta(base, "test/delta.log")
+		So(err, ShouldBeNil)
+		checkDelta(d, orig)
+
+		So(d.Compact("test/compacted"), ShouldBeNil)
+		So(d.Len(), ShouldEqual, 0)
+		So(d.Base().path, ShouldEqual, "test/compacted")
+		So(d.Base().GetWords(0, uint64(len(orig)), []uint64{}), ShouldResemble, rawWords(orig, 0, uint64(len(orig))))
+		checkDelta(d, orig)
+		info, err := os.Stat("test/delta.log")
+		So(err, ShouldBeNil)
+		So(info.Size(), ShouldEqual, 0)
+
+		So(d.Set(10, orig[10] == 0), ShouldBeNil)
+		orig[10] = 1 - orig[10]
+		checkDelta(d, orig)
+		So(d.Close(), ShouldBeNil)
+		d, err = OpenDelta(d.Base(), "test/delta.log")
+		So(err, ShouldBeNil)
+		So(d.Len(), ShouldEqual, 1)
+		checkDelta(d, orig)
+		So(d.Close(), ShouldBeNil)
+
+		// the compacted base is loaded for the previous one
+		d, err = OpenDelta(base, "test/delta.log")
+		So(err, ShouldBeNil)
+		So(d.Base().path, ShouldEqual, "test/compacted")
+		So(d.Len(), ShouldEqual, 1)
+		checkDelta(d, orig)
+		So(d.Close(), ShouldBeNil)
+	})
+
+	Convey("When the last record of the log is partly written", t, func() {
+		f, err := os.OpenFile("test/delta.log", os.O_WRONLY|os.O_APPEND, 0666)
+		So(err, ShouldBeNil)
+		_, err = f.Write([]byte{1, 2, 3})
+		So(err, ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+
+		d, err := OpenDelta(base, "test/delta.log")
+		So(err, ShouldBeNil)
+		So(d.Len(), ShouldEqual, 1)
+		checkDelta(d, orig)
+		info, err := os.Stat("test/delta.log")
+		So(err, ShouldBeNil)
+		So(info.Size(), ShouldEqual, 8)
+		So(d.Set(11, orig[11] == 0), ShouldBeNil)
+		orig[11] = 1 - orig[11]
+		So(d.Close(), ShouldBeNil)
+
+		d, err = OpenDelta(base, "test/delta.log")
+		So(err, ShouldBeNil)
+		checkDelta(d, orig)
+		So(d.Close(), ShouldBeNil)
+	})
+
+	Convey("When a compaction stops before the log is rewritten", t, func() {
+		d, err := OpenDelta(base, "test/delta.log")
+		So(err, ShouldBeNil)
+		for i := 0; i < 50; i++ {
+			pos := rand.Intn(len(orig))
+			So(d.Set(uint64(pos), orig[pos] == 0), ShouldBeNil)
+			orig[pos] = 1 - orig[pos]
+		}
+		log, err := os.ReadFile("test/delta.log")
+		So(err, ShouldBeNil)
+		So(d.Compact("test/compacted3"), ShouldBeNil)
+		So(d.Close(), ShouldBeNil)
+		So(os.WriteFile("test/delta.log", log, 0666), ShouldBeNil)
+
+		d, err = OpenDelta(base, "test/delta.log")
+		So(err, ShouldBeNil)
+		So(d.Base().path, ShouldEqual, "test/compacted3")
+		checkDelta(d, orig)
+
+		So(os.WriteFile("test/notadir", nil, 0666), ShouldBeNil)
+		So(d.Compact("test/notadir"), ShouldNotBeNil)
+		So(d.Base().path, ShouldEqual, "test/compacted3")
+		checkDelta(d, orig)
+
+		os.RemoveAll("test/compacted4")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		So(d.CompactContext(ctx, "test/compacted4"), ShouldEqual, context.Canceled)
+		So(d.Base().path, ShouldEqual, "test/compacted3")
+		_, err = os.Stat("test/compacted4")
+		So(os.IsNotExist(err), ShouldBeTrue)
+		checkDelta(d, orig)
+		So(d.Close(), ShouldBeNil)
+	})
+
+	Convey("When bits are updated during a compaction", t, func() {
+		d, err := OpenDelta(base, "test/delta.log")
+		So(err, ShouldBeNil)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				d.Set(uint64(i), true)
+			}
+		}()
+		err = d.Compact("test/compacted2")
+		wg.Wait()
+		So(err, ShouldBeNil)
+		for i := 0; i < 100; i++ {
+			So(d.Bit(uint64(i)), ShouldBeTrue)
+			orig[i] = 1
+		}
+		So(d.Close(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,288 @@
+package rsdic
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+	"os"
+	"path"
+
+	"golang.org/x/exp/mmap"
+)
+
+// EliasFano represents a non-decreasing sequence of uint64 values S[0...num).
+//
+// Each value is split into its lowBits lower bits and the rest (the upper bits),
+// where lowBits is floor(log2(last/num)) for the last value. The lower bits are
+// packed in low.bin as little-endian 64-bit words, which is mapped for reading.
+// The upper bits are stored in unary as a bit vector, the high RSDic in the
+// subdirectory high: the i-th one is at S[i]>>lowBits + i, and the ones of
+// the values with the upper bits h follow the h-th zero. The number of values
+// and the metadata of the RSDic are stored in manifest.bin.
+//
+// Access uses Select1 of the high RSDic, and NextGEQ and Rank use Select0.
+// The representation takes about 2 + lowBits bits per value.
+//
+// As the queries don't modify it, EliasFano is safe for concurrent queries.
+// An EliasFanoIterator must not be shared between goroutines.
+type EliasFano struct {
+	path    string
+	num     uint64
+	lowBits uint8
+	high    *RSDic
+	low     *mmap.ReaderAt
+}
+
+// eliasFanoManifest is the content of manifest.bin.
+type eliasFanoManifest struct {
+	Num     uint64
+	LowBits uint8
+	High    []byte // MarshalBinary of the high RSDic
+}
+
+const (
+	EF_HIGH_DIR = "high"
+	EF_LOW_FN   = "low.bin"
+)
+
+// BuildEliasFano returns a new EliasFano at dir representing vals, which must be
+// non-decreasing, with its files written and loaded for reading.
+func BuildEliasFano(dir string, vals []uint64) (*EliasFano, error) {
+	for i := 1; i < len(vals); i++ {
+		if vals[i-1] > vals[i] {
+			return nil, fmt.Errorf("rsdic: values are not sorted at %d (%d > %d)", i, vals[i-1], vals[i])
+		}
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	ef := &EliasFano{path: dir, num: uint64(len(vals))}
+	if len(vals) > 0 && vals[len(vals)-1]/uint64(len(vals)) > 0 {
+		ef.lowBits = uint8(bits.Len64(vals[len(vals)-1]/uint64(len(vals))) - 1)
+	}
+	if err := ef.writeLow(vals); err != nil {
+		return nil, err
+	}
+	if err := ef.writeHigh(vals); err != nil {
+		ef.Close()
+		return nil, err
+	}
+	manifest := eliasFanoManifest{Num: ef.num, LowBits: ef.lowBits}
+	meta, err := ef.high.MarshalBinary()
+	if err == nil {
+		manifest.High = meta
+		err = writeManifest(dir, manifest)
+	}
+	if err == nil {
+		ef.low, err = mmap.Open(path.Join(dir, EF_LOW_FN))
+	}
+	if err != nil {
+		ef.Close()
+		return nil, err
+	}
+	return ef, nil
+}
+
+// writeLow writes the lower bits of vals to low.bin, with a word of padding
+// so that a value can always be read from two words.
+func (ef *EliasFano) writeLow(vals []uint64) error {
+	words := make([]uint64, floor(ef.num*uint64(ef.lowBits), kSmallBlockSize)+1)
+	mask := uint64(1)<<ef.lowBits - 1
+	for i, val := range vals {
+		setSlice(words, uint64(i)*uint64(ef.lowBits), ef.lowBits, val&mask)
+	}
+	return writeUint64File(path.Join(ef.path, EF_LOW_FN), words)
+}
+
+// writeHigh writes the upper bits of vals to the high RSDic in unary.
+func (ef *EliasFano) writeHigh(vals []uint64) error {
+	high, err := newOpOutput(path.Join(ef.path, EF_HIGH_DIR))
+	if err != nil {
+		return err
+	}
+	ef.high = high
+	w := &bitWriter{out: high}
+	bucket := uint64(0)
+	for _, val := range vals {
+		for ; bucket < val>>ef.lowBits; bucket++ {
+			w.push(false)
+		}
+		w.push(true)
+	}
+	// the zero ending the last bucket
+	w.push(false)
+	w.flush()
+	return closeOpOutput(high)
+}
+
+// OpenEliasFano loads the EliasFano at dir written by BuildEliasFano.
+func OpenEliasFano(dir string) (*EliasFano, error) {
+	var manifest eliasFanoManifest
+	if err := readManifest(dir, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.LowBits >= 64 {
+		return nil, fmt.Errorf("rsdic: manifest of %s has %d low bits", dir, manifest.LowBits)
+	}
+	ef := &EliasFano{path: dir, num: manifest.Num, lowBits: manifest.LowBits}
+	high, err := New(path.Join(dir, EF_HIGH_DIR))
+	if err != nil {
+		return nil, err
+	}
+	if err := high.UnmarshalBinary(manifest.High); err != nil {
+		return nil, err
+	}
+	if high.OneNum() != ef.num {
+		return nil, fmt.Errorf("rsdic: high bits of %s have %d ones for %d values", dir, high.OneNum(), ef.num)
+	}
+	if err := high.LoadReader(); err != nil {
+		return nil, err
+	}
+	ef.high = high
+	if ef.low, err = mmap.Open(path.Join(dir, EF_LOW_FN)); err != nil {
+		ef.Close()
+		return nil, err
+	}
+	return ef, nil
+}
+
+// Close releases the reader of the high bits and the mapping of the lower bits.
+func (ef *EliasFano) Close() error {
+	var err error
+	if ef.high != nil {
+		err = ef.high.CloseReader()
+	}
+	if ef.low != nil {
+		if closeErr := ef.low.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Num returns the number of values
+func (ef *EliasFano) Num() uint64 {
+	return ef.num
+}
+
+// lowAt returns the lower bits of S[i].
+func (ef *EliasFano) lowAt(i uint64) uint64 {
+	if ef.lowBits == 0 {
+		return 0
+	}
+	pos := i * uint64(ef.lowBits)
+	words := readUint64s(ef.low, pos/kSmallBlockSize, pos/kSmallBlockSize+2)
+	return getSlice(words, pos%kSmallBlockSize, ef.lowBits)
+}
+
+// Access returns S[i]
+func (ef *EliasFano) Access(i uint64) uint64 {
+	if i >= ef.num {
+		panic(fmt.Sprintf("Access: position %d is out of bounds (num = %d)", i, ef.num))
+	}
+	return (ef.high.Select1(i)-i)<<ef.lowBits | ef.lowAt(i)
+}
+
+// NextGEQ returns the smallest i with S[i] >= x and S[i].
+// NextGEQ returns (num, 0) if all values are less than x.
+func (ef *EliasFano) NextGEQ(x uint64) (uint64, uint64) {
+	bucket := x >> ef.lowBits
+	if bucket >= ef.high.ZeroNum() {
+		return ef.num, 0
+	}
+	// the position of the first one of the bucket, if any
+	start := uint64(0)
+	if bucket > 0 {
+		start = ef.high.Select0(bucket-1) + 1
+	}
+	it := ef.iteratorAt(start-bucket, start)
+	for it.Next() {
+		if it.Value() >= x {
+			return it.Index(), it.Value()
+		}
+	}
+	return ef.num, 0
+}
+
+// Rank returns the number of values less than x
+func (ef *EliasFano) Rank(x uint64) uint64 {
+	i, _ := ef.NextGEQ(x)
+	return i
+}
+
+// EliasFanoIterator iterates over the values of an EliasFano in order.
+type EliasFanoIterator struct {
+	ef    *EliasFano
+	wr    *wordReader
+	word  uint64 // the unvisited bits of the current word of the high bits
+	base  uint64 // the position of the current word in the high bits
+	index uint64 // the index of the next value
+	value uint64
+	t     *tracker // of the high bits scanned (IteratorContext only)
+	err   error
+}
+
+// Iterator returns an iterator whose first call of Next moves to S[i].
+func (ef *EliasFano) Iterator(i uint64) *EliasFanoIterator {
+	if i >= ef.num {
+		return &EliasFanoIterator{ef: ef, index: ef.num}
+	}
+	return ef.iteratorAt(i, ef.high.Select1(i))
+}
+
+// IteratorContext is Iterator with cancellation and progress (See context.go),
+// which are checked between large blocks of the high bits scanned by Next.
+// When ctx is done, Next returns false and Err returns ctx.Err().
+func (ef *EliasFano) IteratorContext(ctx context.Context, i uint64) *EliasFanoIterator {
+	it := ef.Iterator(i)
+	it.t = newTracker(ctx, ef.high.num-it.base)
+	return it
+}
+
+// iteratorAt returns an iterator at S[i] whose one in the high bits is
+// at or after pos.
+func (ef *EliasFano) iteratorAt(i uint64, pos uint64) *EliasFanoIterator {
+	it := &EliasFanoIterator{ef: ef, index: i}
+	if i < ef.num {
+		it.wr = ef.high.newWordReader(pos / kSmallBlockSize)
+		it.base = pos - pos%kSmallBlockSize
+		it.word = it.wr.next() &^ (uint64(1)<<(pos%kSmallBlockSize) - 1)
+	}
+	return it
+}
+
+// Next moves to the next value, and returns false if there are no more values.
+func (it *EliasFanoIterator) Next() bool {
+	if it.index >= it.ef.num || it.err != nil {
+		return false
+	}
+	for it.word == 0 {
+		if it.t != nil {
+			if it.err = it.t.add(kSmallBlockSize); it.err != nil {
+				return false
+			}
+		}
+		it.word = it.wr.next()
+		it.base += kSmallBlockSize
+	}
+	pos := it.base + uint64(bits.TrailingZeros64(it.word))
+	it.word &= it.word - 1
+	it.value = (pos-it.index)<<it.ef.lowBits | it.ef.lowAt(it.index)
+	it.index++
+	return true
+}
+
+// Err returns the error of the context which stopped the iterator, if any.
+func (it *EliasFanoIterator) Err() error {
+	return it.err
+}
+
+// Index returns the index of the current value.
+func (it *EliasFanoIterator) Index() uint64 {
+	return it.index - 1
+}
+
+// Value returns the current value.
+func (it *EliasFanoIterator) Value() uint64 {
+	return it.value
+}
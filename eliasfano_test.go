@@ -0,0 +1,121 @@
+package rsdic
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEliasFano(t *testing.T) {
+	vals := make([]uint64, 20000)
+	for i := 1; i < len(vals); i++ {
+		vals[i] = vals[i-1]
+		if rand.Intn(3) != 0 {
+			vals[i] += uint64(rand.ExpFloat64() * 1000)
+		}
+	}
+	built, err := BuildEliasFano("test/eliasfano", vals)
+	if err != nil {
+		panic(err)
+	}
+	defer built.Close()
+
+	checkEliasFano := func(ef *EliasFano) {
+		So(ef.Num(), ShouldEqual, len(vals))
+		for n := 0; n < 1000; n++ {
+			i := uint64(rand.Intn(len(vals)))
+			So(ef.Access(i), ShouldEqual, vals[i])
+
+			x := uint64(rand.Int63n(int64(vals[len(vals)-1] + 100)))
+			rank := uint64(sort.Search(len(vals), func(j int) bool { return vals[j] >= x }))
+			So(ef.Rank(x), ShouldEqual, rank)
+			geq, val := ef.NextGEQ(x)
+			So(geq, ShouldEqual, rank)
+			if rank < ef.Num() {
+				So(val, ShouldEqual, vals[rank])
+			}
+		}
+		So(ef.Rank(0), ShouldEqual, 0)
+		So(ef.Rank(math.MaxUint64), ShouldEqual, ef.Num())
+
+		it := ef.Iterator(0)
+		for i := range vals {
+			So(it.Next(), ShouldBeTrue)
+			if it.Index() != uint64(i) || it.Value() != vals[i] {
+				So(it.Value(), ShouldEqual, vals[i])
+			}
+		}
+		So(it.Next(), ShouldBeFalse)
+		it = ef.Iterator(12345)
+		So(it.Next(), ShouldBeTrue)
+		So(it.Index(), ShouldEqual, 12345)
+		So(it.Value(), ShouldEqual, vals[12345])
+	}
+
+	Convey("When an Elias-Fano sequence is built", t, func() {
+		checkEliasFano(built)
+	})
+
+	Convey("When an Elias-Fano sequence is opened", t, func() {
+		ef, err := OpenEliasFano("test/eliasfano")
+		So(err, ShouldBeNil)
+		defer ef.Close()
+		checkEliasFano(ef)
+	})
+
+	Convey("When an iteration over an Elias-Fano sequence is cancelled", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		it := built.IteratorContext(WithProgress(ctx, func(done uint64, total uint64) {
+			if done > total/2 {
+				cancel()
+			}
+		}), 0)
+		n := 0
+		for ; it.Next(); n++ {
+			So(it.Value(), ShouldEqual, vals[n])
+		}
+		So(it.Err(), ShouldEqual, context.Canceled)
+		So(n, ShouldBeGreaterThan, 0)
+		So(n, ShouldBeLessThan, len(vals))
+		So(it.Next(), ShouldBeFalse)
+
+		it = built.IteratorContext(context.Background(), 0)
+		for n = 0; it.Next(); n++ {
+		}
+		So(it.Err(), ShouldBeNil)
+		So(n, ShouldEqual, len(vals))
+	})
+
+	Convey("When an Elias-Fano sequence has small, large or no values", t, func() {
+		ef, err := BuildEliasFano("test/eliasfano_small", []uint64{0, 0, 3, 3, 3, 9})
+		So(err, ShouldBeNil)
+		So(ef.Access(4), ShouldEqual, 3)
+		So(ef.Rank(3), ShouldEqual, 2)
+		geq, val := ef.NextGEQ(4)
+		So(geq, ShouldEqual, 5)
+		So(val, ShouldEqual, 9)
+		geq, _ = ef.NextGEQ(10)
+		So(geq, ShouldEqual, 6)
+		So(ef.Close(), ShouldBeNil)
+
+		ef, err = BuildEliasFano("test/eliasfano_small", []uint64{1, math.MaxUint64 - 1, math.MaxUint64})
+		So(err, ShouldBeNil)
+		So(ef.Access(2), ShouldEqual, uint64(math.MaxUint64))
+		So(ef.Rank(math.MaxUint64), ShouldEqual, 2)
+		So(ef.Close(), ShouldBeNil)
+
+		ef, err = BuildEliasFano("test/eliasfano_small", nil)
+		So(err, ShouldBeNil)
+		So(ef.Num(), ShouldEqual, 0)
+		So(ef.Rank(5), ShouldEqual, 0)
+		So(ef.Iterator(0).Next(), ShouldBeFalse)
+		So(ef.Close(), ShouldBeNil)
+
+		_, err = BuildEliasFano("test/eliasfano_small", []uint64{2, 1})
+		So(err, ShouldNotBeNil)
+	})
+}
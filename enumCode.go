@@ -1,7 +1,9 @@
 package rsdic
 
+import "math/bits"
+
 func enumEncode(val uint64, rankSB uint8) uint64 {
-	if kEnumCodeLength[rankSB] == kSmallBlockSize {
+	if isRawBlock(rankSB) {
 		return val
 	}
 	code := uint64(0)
@@ -14,8 +16,47 @@ func enumEncode(val uint64, rankSB uint8) uint64 {
 	return code
 }
 
+// enumDecode, enumBit, enumRank, enumSelect1 and enumSelect0 dispatch to
+// either the bit-by-bit decoders below (default) or the table driven
+// decoders in enumLUT.go (built with -tags rsdic_enumlut).
+
 func enumDecode(code uint64, rankSB uint8) uint64 {
-	if kEnumCodeLength[rankSB] == kSmallBlockSize {
+	if useEnumLUT {
+		return enumDecodeLUT(code, rankSB)
+	}
+	return enumDecodeScan(code, rankSB)
+}
+
+func enumBit(code uint64, rankSB uint8, pos uint8) bool {
+	if useEnumLUT {
+		return enumBitLUT(code, rankSB, pos)
+	}
+	return enumBitScan(code, rankSB, pos)
+}
+
+func enumRank(code uint64, rankSB uint8, pos uint8) uint8 {
+	if useEnumLUT {
+		return enumRankLUT(code, rankSB, pos)
+	}
+	return enumRankScan(code, rankSB, pos)
+}
+
+func enumSelect1(code uint64, rankSB uint8, rank uint8) uint8 {
+	if useEnumLUT {
+		return enumSelect1LUT(code, rankSB, rank)
+	}
+	return enumSelect1Scan(code, rankSB, rank)
+}
+
+func enumSelect0(code uint64, rankSB uint8, rank uint8) uint8 {
+	if useEnumLUT {
+		return enumSelect0LUT(code, rankSB, rank)
+	}
+	return enumSelect0Scan(code, rankSB, rank)
+}
+
+func enumDecodeScan(code uint64, rankSB uint8) uint64 {
+	if isRawBlock(rankSB) {
 		return code
 	}
 	val := uint64(0)
@@ -30,8 +71,8 @@ func enumDecode(code uint64, rankSB uint8) uint64 {
 	return val
 }
 
-func enumBit(code uint64, rankSB uint8, pos uint8) bool {
-	if kEnumCodeLength[rankSB] == kSmallBlockSize {
+func enumBitScan(code uint64, rankSB uint8, pos uint8) bool {
+	if isRawBlock(rankSB) {
 		return getBit(code, pos)
 	}
 	for i := uint8(0); i < pos; i++ {
@@ -52,7 +93,7 @@ func runZerosRaw(code uint64, pos uint8) uint8 {
 }
 
 func enumRunZeros(code uint64, rankSB uint8, pos uint8) uint8 {
-	if kEnumCodeLength[rankSB] == kSmallBlockSize {
+	if isRawBlock(rankSB) {
 		return runZerosRaw(code, pos)
 	}
 	for i := uint8(0); i < pos; i++ {
@@ -71,8 +112,8 @@ func enumRunZeros(code uint64, rankSB uint8, pos uint8) uint8 {
 	return kSmallBlockSize - pos
 }
 
-func enumRank(code uint64, rankSB uint8, pos uint8) uint8 {
-	if kEnumCodeLength[rankSB] == kSmallBlockSize {
+func enumRankScan(code uint64, rankSB uint8, pos uint8) uint8 {
+	if isRawBlock(rankSB) {
 		return popCount(code & ((1 << pos) - 1))
 	}
 	curRank := rankSB
@@ -95,8 +136,8 @@ func enumSelect(code uint64, rankSB uint8, rank uint8, bit bool) uint8 {
 	}
 }
 
-func enumSelect1(code uint64, rankSB uint8, rank uint8) uint8 {
-	if kEnumCodeLength[rankSB] == kSmallBlockSize {
+func enumSelect1Scan(code uint64, rankSB uint8, rank uint8) uint8 {
+	if isRawBlock(rankSB) {
 		return selectRaw(code, rank)
 	}
 	for i := uint8(0); i < kSmallBlockSize; i++ {
@@ -113,8 +154,8 @@ func enumSelect1(code uint64, rankSB uint8, rank uint8) uint8 {
 	return 0 // should not come
 }
 
-func enumSelect0(code uint64, rankSB uint8, rank uint8) uint8 {
-	if kEnumCodeLength[rankSB] == kSmallBlockSize {
+func enumSelect0Scan(code uint64, rankSB uint8, rank uint8) uint8 {
+	if isRawBlock(rankSB) {
 		return selectRaw(^code, rank)
 	}
 	for i := uint8(0); i < kSmallBlockSize; i++ {
@@ -133,20 +174,40 @@ func enumSelect0(code uint64, rankSB uint8, rank uint8) uint8 {
 }
 
 func selectRaw(code uint64, rank uint8) uint8 {
-	for i := uint8(0); i < kSmallBlockSize; i++ {
-		if getBit(code, i) {
-			rank--
-			if rank == 0 {
-				return i
-			}
-		}
+	for ; rank > 1; rank-- {
+		code &= code - 1 // clear the lowest one
 	}
-	return 0 // should not come
+	if code == 0 {
+		return 0 // should not come
+	}
+	return uint8(bits.TrailingZeros64(code))
 }
 
 var kCombinationTable64 [][]uint64
+
+// kEnumCodeLength[rankSB] is the number of bits of the code of a small block
+// with rankSB ones, which is kSmallBlockSize for raw blocks.
 var kEnumCodeLength []uint8
 
+// enumCodeLength returns the code length of a small block with rankSB ones.
+// A block is stored raw if its enumerative code takes kUseRawLen bits or more,
+// since decoding such a long code costs much more than the few bits it saves.
+// As the code lengths determine the layout of bits.bin, changing kUseRawLen
+// needs a new kFormatVersion.
+func enumCodeLength(rankSB uint8) uint8 {
+	codeLen := uint8(bits.Len64(kCombinationTable64[kSmallBlockSize][rankSB] - 1))
+	if codeLen >= kUseRawLen {
+		return kSmallBlockSize
+	}
+	return codeLen
+}
+
+// isRawBlock reports whether a small block with rankSB ones is stored raw,
+// in which case its bits are decoded by popCount and selectRaw.
+func isRawBlock(rankSB uint8) bool {
+	return kEnumCodeLength[rankSB] == kSmallBlockSize
+}
+
 func init() {
 	kCombinationTable64 = [][]uint64{
 		{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
@@ -214,10 +275,10 @@ func init() {
 		{1, 62, 1891, 37820, 557845, 6471002, 61474519, 491796152, 3381098545, 20286591270, 107518933731, 508271323092, 2160153123141, 8308281242850, 29078984349975, 93052749919920, 273342452889765, 739632519584070, 1849081298960175, 4282083008118300, 9206478467454345, 18412956934908690, 34315056105966195, 59678358445158600, 96977332473382725, 147405545359541742, 209769429934732479, 279692573246309972, 349615716557887465, 409894288378212890, 450883717216034179, 465428353255261088, 450883717216034179, 409894288378212890, 349615716557887465, 279692573246309972, 209769429934732479, 147405545359541742, 96977332473382725, 59678358445158600, 34315056105966195, 18412956934908690, 9206478467454345, 4282083008118300, 1849081298960175, 739632519584070, 273342452889765, 93052749919920, 29078984349975, 8308281242850, 2160153123141, 508271323092, 107518933731, 20286591270, 3381098545, 491796152, 61474519, 6471002, 557845, 37820, 1891, 62, 1, 0, 0},
 		{1, 63, 1953, 39711, 595665, 7028847, 67945521, 553270671, 3872894697, 23667689815, 127805525001, 615790256823, 2668424446233, 10468434365991, 37387265592825, 122131734269895, 366395202809685, 1012974972473835, 2588713818544245, 6131164307078475, 13488561475572645, 27619435402363035, 52728013040874885, 93993414551124795, 156655690918541325, 244382877832924467, 357174975294274221, 489462003181042451, 629308289804197437, 759510004936100355, 860778005594247069, 916312070471295267, 916312070471295267, 860778005594247069, 759510004936100355, 629308289804197437, 489462003181042451, 357174975294274221, 244382877832924467, 156655690918541325, 93993414551124795, 52728013040874885, 27619435402363035, 13488561475572645, 6131164307078475, 2588713818544245, 1012974972473835, 366395202809685, 122131734269895, 37387265592825, 10468434365991, 2668424446233, 615790256823, 127805525001, 23667689815, 3872894697, 553270671, 67945521, 7028847, 595665, 39711, 1953, 63, 1, 0},
 		{1, 64, 2016, 41664, 635376, 7624512, 74974368, 621216192, 4426165368, 27540584512, 151473214816, 743595781824, 3284214703056, 13136858812224, 47855699958816, 159518999862720, 488526937079580, 1379370175283520, 3601688791018080, 8719878125622720, 19619725782651120, 41107996877935680, 80347448443237920, 146721427591999680, 250649105469666120, 401038568751465792, 601557853127198688, 846636978475316672, 1118770292985239888, 1388818294740297792, 1620288010530347424, 1777090076065542336, 1832624140942590534, 1777090076065542336, 1620288010530347424, 1388818294740297792, 1118770292985239888, 846636978475316672, 601557853127198688, 401038568751465792, 250649105469666120, 146721427591999680, 80347448443237920, 41107996877935680, 19619725782651120, 8719878125622720, 3601688791018080, 1379370175283520, 488526937079580, 159518999862720, 47855699958816, 13136858812224, 3284214703056, 743595781824, 151473214816, 27540584512, 4426165368, 621216192, 74974368, 7624512, 635376, 41664, 2016, 64, 1}}
-	kEnumCodeLength = []uint8{
-		0, 6, 11, 16, 20, 23, 27, 30, 33, 35, 38, 40, 42, 44, 46, 64,
-		64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64,
-		64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64,
-		64, 64, 46, 44, 42, 40, 38, 35, 33, 30, 27, 23, 20, 16, 11, 6,
-		0}
+	kEnumCodeLength = make([]uint8, kSmallBlockSize+1)
+	for rankSB := 0; rankSB <= kSmallBlockSize; rankSB++ {
+		kEnumCodeLength[rankSB] = enumCodeLength(uint8(rankSB))
+	}
+
+	initEnumLUT()
 }
@@ -2,6 +2,7 @@ package rsdic
 
 import (
 	. "github.com/smartystreets/goconvey/convey"
+	"math/bits"
 	"math/rand"
 	"testing"
 )
@@ -55,7 +56,7 @@ func runTestenumCode(x uint64, t *testing.T) {
 	})
 }
 
-func TestenumCode(t *testing.T) {
+func TestEnumCode(t *testing.T) {
 	runTestenumCode(uint64(0), t)
 	testN := 2
 	for pc := 0; pc < 64; pc++ {
@@ -69,3 +70,118 @@ func TestenumCode(t *testing.T) {
 		}
 	}
 }
+
+func randomBlock(pc int) uint64 {
+	x := uint64(0)
+	for _, pos := range rand.Perm(64)[:pc] {
+		x |= (1 << uint(pos))
+	}
+	return x
+}
+
+func TestEnumLUTMatchesScan(t *testing.T) {
+	Convey("When a block is decoded with the lookup tables", t, func() {
+		testN := 8
+		for pc := 0; pc <= 64; pc++ {
+			for i := 0; i < testN; i++ {
+				x := randomBlock(pc)
+				rankSB := uint8(pc)
+				code := enumEncode(x, rankSB)
+				So(enumDecodeLUT(code, rankSB), ShouldEqual, x)
+				So(enumDecodeScan(code, rankSB), ShouldEqual, x)
+				for pos := uint8(0); pos < 64; pos++ {
+					So(enumBitLUT(code, rankSB, pos), ShouldEqual, enumBitScan(code, rankSB, pos))
+					So(enumRankLUT(code, rankSB, pos), ShouldEqual, enumRankScan(code, rankSB, pos))
+				}
+				for rank := uint8(1); rank <= rankSB; rank++ {
+					So(enumSelect1LUT(code, rankSB, rank), ShouldEqual, enumSelect1Scan(code, rankSB, rank))
+				}
+				for rank := uint8(1); rank <= 64-rankSB; rank++ {
+					So(enumSelect0LUT(code, rankSB, rank), ShouldEqual, enumSelect0Scan(code, rankSB, rank))
+				}
+			}
+		}
+	})
+}
+
+func setupEnumCodes(pc int) ([]uint64, []uint8) {
+	codes := make([]uint64, 1024)
+	ranks := make([]uint8, 1024)
+	for i := range codes {
+		ranks[i] = uint8(pc)
+		codes[i] = enumEncode(randomBlock(pc), ranks[i])
+	}
+	return codes, ranks
+}
+
+func BenchmarkEnumRankScan(b *testing.B) {
+	codes, ranks := setupEnumCodes(4)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enumRankScan(codes[i%1024], ranks[i%1024], uint8(i%64))
+	}
+}
+
+func BenchmarkEnumRankLUT(b *testing.B) {
+	codes, ranks := setupEnumCodes(4)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enumRankLUT(codes[i%1024], ranks[i%1024], uint8(i%64))
+	}
+}
+
+func BenchmarkEnumSelect1Scan(b *testing.B) {
+	codes, ranks := setupEnumCodes(60)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enumSelect1Scan(codes[i%1024], ranks[i%1024], uint8(i%60)+1)
+	}
+}
+
+func BenchmarkEnumSelect1LUT(b *testing.B) {
+	codes, ranks := setupEnumCodes(60)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enumSelect1LUT(codes[i%1024], ranks[i%1024], uint8(i%60)+1)
+	}
+}
+
+func BenchmarkEnumSelect0Scan(b *testing.B) {
+	codes, ranks := setupEnumCodes(4)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enumSelect0Scan(codes[i%1024], ranks[i%1024], uint8(i%60)+1)
+	}
+}
+
+func BenchmarkEnumSelect0LUT(b *testing.B) {
+	codes, ranks := setupEnumCodes(4)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enumSelect0LUT(codes[i%1024], ranks[i%1024], uint8(i%60)+1)
+	}
+}
+
+func TestEnumCodeLength(t *testing.T) {
+	Convey("When code lengths are derived from kUseRawLen", t, func() {
+		for rankSB := 0; rankSB <= 64; rankSB++ {
+			codeLen := kEnumCodeLength[rankSB]
+			if isRawBlock(uint8(rankSB)) {
+				So(bits.Len64(kCombinationTable64[64][rankSB]-1), ShouldBeGreaterThanOrEqualTo, kUseRawLen)
+				continue
+			}
+			So(codeLen, ShouldBeLessThan, kUseRawLen)
+			// all codes of the class should fit in codeLen bits
+			if codeLen < 64 {
+				So(kCombinationTable64[64][rankSB], ShouldBeLessThanOrEqualTo, uint64(1)<<codeLen)
+			}
+		}
+		// the code lengths of format version 0, which was written with a fixed table
+		So(kEnumCodeLength, ShouldResemble, []uint8{
+			0, 6, 11, 16, 20, 23, 27, 30, 33, 35, 38, 40, 42, 44, 46, 64,
+			64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64,
+			64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64, 64,
+			64, 64, 46, 44, 42, 40, 38, 35, 33, 30, 27, 23, 20, 16, 11, 6,
+			0})
+	})
+}
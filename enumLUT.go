@@ -0,0 +1,172 @@
+package rsdic
+
+// Table driven in-block decoding of enumerative codes.
+//
+// The scan decoders in enumCode.go look at every position of a small block,
+// and pay a mispredicted branch at almost every one. Since only sparse and
+// dense blocks are enumeratively coded (See enumCodeLength), the decoders here
+// jump from one to the next one of a sparse block instead, and decode a dense
+// block as the complement of a sparse one.
+//
+// For a block whose remaining positions are [i, 64) with k ones, code < C(64-i, k)
+// and bit i is one iff code >= C(63-i, k), thus the next one is at 63-n for the
+// largest n such that C(n, k) <= code, which is found by a binary search over
+// the column kOneThresholdTable[k] (n < 64-i holds by itself), after which
+// C(n, k) is consumed from code as by the scan.
+//
+// The codes are the ranks of the blocks in lexicographic order, which the
+// complement reverses, thus the code of the complement of a block with k ones
+// is C(64, k) - 1 - code.
+
+// kOneThresholdTable[k][n] = C(n, k), a column of kCombinationTable64
+// laid out contiguously for the binary searches.
+var kOneThresholdTable [kSmallBlockSize + 1][kSmallBlockSize]uint64
+
+func initEnumLUT() {
+	for k := 0; k <= kSmallBlockSize; k++ {
+		for n := 0; n < kSmallBlockSize; n++ {
+			kOneThresholdTable[k][n] = kCombinationTable64[n][k]
+		}
+	}
+}
+
+// sparseCode returns the code and the number of ones of the sparser of the block
+// and its complement, and whether it is the complement.
+func sparseCode(code uint64, rankSB uint8) (uint64, uint8, bool) {
+	if rankSB <= kSmallBlockSize/2 {
+		return code, rankSB, false
+	}
+	return kCombinationTable64[kSmallBlockSize][rankSB] - 1 - code, kSmallBlockSize - rankSB, true
+}
+
+// enumNextOne returns the position of the next one of code with k > 0 remaining ones,
+// and the code after it.
+func enumNextOne(code uint64, k uint8) (uint8, uint64) {
+	col := &kOneThresholdTable[k]
+	n := 0
+	// col[0] = C(0, k) = 0 <= code
+	if col[n+32] <= code {
+		n += 32
+	}
+	if col[n+16] <= code {
+		n += 16
+	}
+	if col[n+8] <= code {
+		n += 8
+	}
+	if col[n+4] <= code {
+		n += 4
+	}
+	if col[n+2] <= code {
+		n += 2
+	}
+	if col[n+1] <= code {
+		n++
+	}
+	return uint8(kSmallBlockSize - 1 - n), code - col[n]
+}
+
+// sparseRank returns the number of ones before pos of a sparse code with k ones.
+func sparseRank(code uint64, k uint8, pos uint8) uint8 {
+	rank := uint8(0)
+	for ; rank < k; rank++ {
+		var p uint8
+		p, code = enumNextOne(code, k-rank)
+		if p >= pos {
+			break
+		}
+	}
+	return rank
+}
+
+// sparseBit returns B[pos] of a sparse code with k ones.
+func sparseBit(code uint64, k uint8, pos uint8) bool {
+	for ; k > 0; k-- {
+		var p uint8
+		p, code = enumNextOne(code, k)
+		if p >= pos {
+			return p == pos
+		}
+	}
+	return false
+}
+
+func sparseSelect1(code uint64, k uint8, rank uint8) uint8 {
+	var p uint8
+	for i := uint8(0); i < rank; i++ {
+		p, code = enumNextOne(code, k-i)
+	}
+	return p
+}
+
+// sparseSelect0 counts the ones before the rank-th zero, which is before the
+// first one p with p-ones (the zeros before p) >= rank.
+func sparseSelect0(code uint64, k uint8, rank uint8) uint8 {
+	ones := uint8(0)
+	for ; ones < k; ones++ {
+		var p uint8
+		p, code = enumNextOne(code, k-ones)
+		if p-ones >= rank {
+			break
+		}
+	}
+	return rank - 1 + ones
+}
+
+func enumDecodeLUT(code uint64, rankSB uint8) uint64 {
+	if isRawBlock(rankSB) {
+		return code
+	}
+	code, k, complement := sparseCode(code, rankSB)
+	val := uint64(0)
+	for ; k > 0; k-- {
+		var p uint8
+		p, code = enumNextOne(code, k)
+		val |= 1 << p
+	}
+	if complement {
+		return ^val
+	}
+	return val
+}
+
+func enumBitLUT(code uint64, rankSB uint8, pos uint8) bool {
+	if isRawBlock(rankSB) {
+		return getBit(code, pos)
+	}
+	code, k, complement := sparseCode(code, rankSB)
+	return sparseBit(code, k, pos) != complement
+}
+
+func enumRankLUT(code uint64, rankSB uint8, pos uint8) uint8 {
+	if isRawBlock(rankSB) {
+		return popCount(code & ((1 << pos) - 1))
+	}
+	code, k, complement := sparseCode(code, rankSB)
+	if complement {
+		return pos - sparseRank(code, k, pos)
+	}
+	return sparseRank(code, k, pos)
+}
+
+func enumSelect1LUT(code uint64, rankSB uint8, rank uint8) uint8 {
+	if isRawBlock(rankSB) {
+		return selectRaw(code, rank)
+	}
+	code, k, complement := sparseCode(code, rankSB)
+	if complement {
+		return sparseSelect0(code, k, rank)
+	}
+	return sparseSelect1(code, k, rank)
+}
+
+func enumSelect0LUT(code uint64, rankSB uint8, rank uint8) uint8 {
+	if isRawBlock(rankSB) {
+		return selectRaw(^code, rank)
+	}
+	code, k, complement := sparseCode(code, rankSB)
+	if complement {
+		return sparseSelect1(code, k, rank)
+	}
+	return sparseSelect0(code, k, rank)
+}
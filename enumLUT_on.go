@@ -0,0 +1,5 @@
+//go:build rsdic_enumlut
+
+package rsdic
+
+const useEnumLUT = true
@@ -0,0 +1,440 @@
+package rsdic
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+
+	"golang.org/x/exp/mmap"
+)
+
+// FMIndex is a compressed full-text index of a byte text T[0...num) [1],
+// which counts and locates the occurrences of patterns and extracts
+// substrings of T without keeping T.
+//
+// T is terminated by a sentinel $ smaller than all bytes, and the byte c is the
+// symbol c+1 (the sentinel is 0). The Burrows-Wheeler transform of T$, the
+// symbols before the sorted suffixes of T$, is stored as a WaveletMatrix in the
+// subdirectory bwt of the directory, and a pattern is searched backward by
+// its Rank. The rows of the suffixes starting at the multiples of the sample
+// rate are marked by the ones of an RSDic in the subdirectory sampled, and
+// their positions are stored in samples.bin in the order of the rows, so that
+// a row is located by stepping back in T to a marked row. The rows of the
+// suffixes at the multiples of the sample rate are stored in isa.bin, from
+// which substrings are extracted backward. The files of 64-bit values are
+// mapped for reading, and the counts of the symbols and the metadata of the
+// RSDic are stored in manifest.bin.
+//
+// As the queries don't modify it, FMIndex is safe for concurrent queries.
+//
+// [1] "Opportunistic Data Structures with Applications", Paolo Ferragina and
+// Giovanni Manzini, FOCS 2000
+type FMIndex struct {
+	path       string
+	num        uint64
+	sampleRate uint64
+	c          []uint64 // the number of symbols less than each symbol in the BWT
+	bwt        *WaveletMatrix
+	sampled    *RSDic
+	samples    *mmap.ReaderAt
+	isa        *mmap.ReaderAt
+}
+
+// fmManifest is the content of manifest.bin.
+type fmManifest struct {
+	Num        uint64
+	SampleRate uint64
+	C          []uint64
+	Sampled    []byte // MarshalBinary of the RSDic
+}
+
+const (
+	FM_BWT_DIR     = "bwt"
+	FM_SAMPLED_DIR = "sampled"
+	FM_SAMPLES_FN  = "samples.bin"
+	FM_ISA_FN      = "isa.bin"
+
+	kFMSymbolNum = 257 // the bytes and the sentinel
+)
+
+// BuildFMIndex returns a new FMIndex at dir of text, with its files written and
+// loaded for reading. A position of every sampleRate positions of text is
+// sampled, so that Locate and Extract take O(sampleRate) steps per position
+// and the samples take 2*64/sampleRate bits per byte of text.
+//
+// The suffix array, the BWT and the levels of its WaveletMatrix are built in
+// memory as 32-bit values, which take about 12 bytes per byte of text at the
+// peak in addition to text, and thus text must be shorter than 2^31-1 bytes.
+func BuildFMIndex(dir string, text []byte, sampleRate uint64) (*FMIndex, error) {
+	if sampleRate == 0 {
+		return nil, fmt.Errorf("rsdic: sample rate must be positive")
+	}
+	if len(text) >= math.MaxInt32 {
+		return nil, fmt.Errorf("rsdic: text of %d bytes is too long for an FMIndex", len(text))
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	sa := suffixArray(text)
+	fm := &FMIndex{path: dir, num: uint64(len(text)), sampleRate: sampleRate, c: make([]uint64, kFMSymbolNum+1)}
+	bwt := make([]uint32, len(sa))
+	samples := []uint64{}
+	isa := make([]uint64, fm.num/sampleRate+1)
+	sampled, err := newOpOutput(path.Join(dir, FM_SAMPLED_DIR))
+	if err != nil {
+		return nil, err
+	}
+	w := &bitWriter{out: sampled}
+	for row, p := range sa {
+		pos := uint64(p)
+		if pos > 0 {
+			bwt[row] = uint32(text[pos-1]) + 1
+		}
+		fm.c[bwt[row]+1]++
+		w.push(pos%sampleRate == 0)
+		if pos%sampleRate == 0 {
+			samples = append(samples, pos)
+			isa[pos/sampleRate] = uint64(row)
+		}
+	}
+	w.flush()
+	if err := closeOpOutput(sampled); err != nil {
+		removeOutput(sampled)
+		return nil, err
+	}
+	fm.sampled = sampled
+	for c := 1; c <= kFMSymbolNum; c++ {
+		fm.c[c] += fm.c[c-1]
+	}
+	if fm.bwt, err = BuildWaveletMatrix(path.Join(dir, FM_BWT_DIR), bwt); err != nil {
+		fm.Close()
+		return nil, err
+	}
+	err = writeUint64File(path.Join(dir, FM_SAMPLES_FN), samples)
+	if err == nil {
+		err = writeUint64File(path.Join(dir, FM_ISA_FN), isa)
+	}
+	if err == nil {
+		err = fm.writeManifest()
+	}
+	if err == nil {
+		err = fm.openFiles()
+	}
+	if err != nil {
+		fm.Close()
+		return nil, err
+	}
+	return fm, nil
+}
+
+// suffixArray returns the starting positions of the sorted suffixes of text$
+// by SA-IS [2] in O(n) time.
+//
+// [2] "Two Efficient Algorithms for Linear Time Suffix Array Construction",
+// Ge Nong, Sen Zhang and Wai Hong Chan, IEEE Transactions on Computers 2011
+func suffixArray(text []byte) []int32 {
+	s := make([]int32, len(text)+1)
+	for i, c := range text {
+		s[i] = int32(c) + 1
+	}
+	sa := make([]int32, len(s))
+	sais(s, sa, kFMSymbolNum)
+	return sa
+}
+
+// sais sets sa to the suffix array of s over the symbols [0, k),
+// whose last symbol is 0 and the only 0.
+func sais(s []int32, sa []int32, k int) {
+	n := len(s)
+	if n == 1 {
+		sa[0] = 0
+		return
+	}
+	// the suffix i is of type S if it is smaller than the suffix i+1, and of type L otherwise
+	stype := make([]bool, n)
+	stype[n-1] = true
+	for i := n - 2; i >= 0; i-- {
+		stype[i] = s[i] < s[i+1] || (s[i] == s[i+1] && stype[i+1])
+	}
+	// the leftmost S-type suffixes (LMS), i.e. those of type S after one of type L
+	lms := func(i int32) bool {
+		return i > 0 && stype[i] && !stype[i-1]
+	}
+	bkt := make([]int32, k)
+	// buckets sets bkt to the starts (or ends) of the buckets of the symbols in sa
+	buckets := func(end bool) {
+		clear(bkt)
+		for _, c := range s {
+			bkt[c]++
+		}
+		sum := int32(0)
+		for c := range bkt {
+			sum += bkt[c]
+			if end {
+				bkt[c] = sum
+			} else {
+				bkt[c] = sum - bkt[c]
+			}
+		}
+	}
+	// induce sorts the L-type suffixes from the LMS ones in sa, and then the S-type ones
+	induce := func() {
+		buckets(false)
+		for i := 0; i < n; i++ {
+			if j := sa[i] - 1; j >= 0 && !stype[j] {
+				sa[bkt[s[j]]] = j
+				bkt[s[j]]++
+			}
+		}
+		buckets(true)
+		for i := n - 1; i >= 0; i-- {
+			if j := sa[i] - 1; j >= 0 && stype[j] {
+				bkt[s[j]]--
+				sa[bkt[s[j]]] = j
+			}
+		}
+	}
+
+	// sort the LMS substrings (from an LMS suffix to the next) by inducing from the LMS suffixes
+	for i := range sa {
+		sa[i] = -1
+	}
+	buckets(true)
+	for i := int32(1); i < int32(n); i++ {
+		if lms(i) {
+			bkt[s[i]]--
+			sa[bkt[s[i]]] = i
+		}
+	}
+	induce()
+
+	// name the sorted LMS substrings, storing the name of the LMS suffix i in sa[m+i/2]
+	m := 0
+	for i := 0; i < n; i++ {
+		if lms(sa[i]) {
+			sa[m] = sa[i]
+			m++
+		}
+	}
+	for i := m; i < n; i++ {
+		sa[i] = -1
+	}
+	name := int32(0)
+	prev := int32(-1)
+	for i := 0; i < m; i++ {
+		pos := sa[i]
+		diff := prev < 0
+		for d := int32(0); !diff; d++ {
+			if s[pos+d] != s[prev+d] || stype[pos+d] != stype[prev+d] {
+				diff = true
+			} else if d > 0 && (lms(pos+d) || lms(prev+d)) {
+				break
+			}
+		}
+		if diff {
+			name++
+			prev = pos
+		}
+		sa[m+int(pos)/2] = name - 1
+	}
+	j := n - 1
+	for i := n - 1; i >= m; i-- {
+		if sa[i] >= 0 {
+			sa[j] = sa[i]
+			j--
+		}
+	}
+
+	// sort the LMS suffixes by the suffix array of their names in the order in s,
+	// recursively if the names are not unique
+	s1, sa1 := sa[n-m:], sa[:m]
+	if int(name) < m {
+		sais(s1, sa1, int(name))
+	} else {
+		for i, c := range s1 {
+			sa1[c] = int32(i)
+		}
+	}
+	j = 0
+	for i := int32(1); i < int32(n); i++ {
+		if lms(i) {
+			s1[j] = i
+			j++
+		}
+	}
+	for i := range sa1 {
+		sa1[i] = s1[sa1[i]]
+	}
+	for i := m; i < n; i++ {
+		sa[i] = -1
+	}
+
+	// sort all suffixes by inducing from the sorted LMS suffixes at the ends of their buckets
+	buckets(true)
+	for i := m - 1; i >= 0; i-- {
+		j := sa[i]
+		sa[i] = -1
+		bkt[s[j]]--
+		sa[bkt[s[j]]] = j
+	}
+	induce()
+}
+
+func (fm *FMIndex) writeManifest() error {
+	meta, err := fm.sampled.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return writeManifest(fm.path, fmManifest{Num: fm.num, SampleRate: fm.sampleRate, C: fm.c, Sampled: meta})
+}
+
+// openFiles maps samples.bin and isa.bin.
+func (fm *FMIndex) openFiles() error {
+	var err error
+	if fm.samples, err = mmap.Open(path.Join(fm.path, FM_SAMPLES_FN)); err != nil {
+		return err
+	}
+	if fm.isa, err = mmap.Open(path.Join(fm.path, FM_ISA_FN)); err != nil {
+		return err
+	}
+	if uint64(fm.samples.Len()) != fm.sampled.OneNum()*8 || uint64(fm.isa.Len()) != (fm.num/fm.sampleRate+1)*8 {
+		return fmt.Errorf("rsdic: %s or %s of %s has a wrong size", FM_SAMPLES_FN, FM_ISA_FN, fm.path)
+	}
+	return nil
+}
+
+// OpenFMIndex loads the FMIndex at dir written by BuildFMIndex.
+func OpenFMIndex(dir string) (*FMIndex, error) {
+	var manifest fmManifest
+	if err := readManifest(dir, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.SampleRate == 0 || len(manifest.C) != kFMSymbolNum+1 {
+		return nil, fmt.Errorf("rsdic: manifest of %s has sample rate %d and %d symbol counts",
+			dir, manifest.SampleRate, len(manifest.C))
+	}
+	fm := &FMIndex{path: dir, num: manifest.Num, sampleRate: manifest.SampleRate, c: manifest.C}
+	sampled, err := New(path.Join(dir, FM_SAMPLED_DIR))
+	if err != nil {
+		return nil, err
+	}
+	if err := sampled.UnmarshalBinary(manifest.Sampled); err != nil {
+		sampled.CloseReader()
+		return nil, err
+	}
+	if sampled.Num() != fm.num+1 {
+		sampled.CloseReader()
+		return nil, fmt.Errorf("rsdic: sampled bits of %s have length %d for %d bytes", dir, sampled.Num(), fm.num)
+	}
+	if err := sampled.LoadReader(); err != nil {
+		// which may have taken the lock
+		sampled.CloseReader()
+		return nil, err
+	}
+	fm.sampled = sampled
+	if fm.bwt, err = OpenWaveletMatrix(path.Join(dir, FM_BWT_DIR)); err == nil && fm.bwt.Num() != fm.num+1 {
+		err = fmt.Errorf("rsdic: BWT of %s has length %d for %d bytes", dir, fm.bwt.Num(), fm.num)
+	}
+	if err == nil {
+		err = fm.openFiles()
+	}
+	if err != nil {
+		fm.Close()
+		return nil, err
+	}
+	return fm, nil
+}
+
+// Close releases the readers of the BWT and the sampled rows, and the mappings of the samples.
+func (fm *FMIndex) Close() error {
+	var err error
+	if fm.bwt != nil {
+		err = fm.bwt.Close()
+	}
+	if closeErr := fm.sampled.CloseReader(); err == nil {
+		err = closeErr
+	}
+	for _, r := range []*mmap.ReaderAt{fm.samples, fm.isa} {
+		if r == nil {
+			continue
+		}
+		if closeErr := r.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Len returns the length of the text
+func (fm *FMIndex) Len() uint64 {
+	return fm.num
+}
+
+// lf returns the row of the suffix one position before that of row (LF mapping),
+// and the symbol between them.
+func (fm *FMIndex) lf(row uint64) (uint64, uint32) {
+	c, rank := fm.bwt.accessRank(row)
+	return fm.c[c] + rank, c
+}
+
+// search returns the range of the rows of the suffixes starting with pattern.
+func (fm *FMIndex) search(pattern []byte) (uint64, uint64) {
+	sp, ep := uint64(0), fm.num+1
+	for i := len(pattern) - 1; i >= 0 && sp < ep; i-- {
+		c := uint32(pattern[i]) + 1
+		sp, ep = fm.c[c]+fm.bwt.Rank(c, sp), fm.c[c]+fm.bwt.Rank(c, ep)
+	}
+	return sp, ep
+}
+
+// Count returns the number of occurrences of pattern in T
+// (Len()+1 for the empty pattern)
+func (fm *FMIndex) Count(pattern []byte) uint64 {
+	sp, ep := fm.search(pattern)
+	return ep - sp
+}
+
+// Locate returns the positions of the occurrences of pattern in T in the ascending order
+func (fm *FMIndex) Locate(pattern []byte) []uint64 {
+	sp, ep := fm.search(pattern)
+	poss := make([]uint64, 0, ep-sp)
+	for row := sp; row < ep; row++ {
+		r, steps := row, uint64(0)
+		for {
+			// the row of the suffix at 0 is sampled, so that this stops before the sentinel
+			sampled, rank := fm.sampled.BitAndRank(r)
+			if sampled {
+				poss = append(poss, readUint64(fm.samples, rank)+steps)
+				break
+			}
+			r, _ = fm.lf(r)
+			steps++
+		}
+	}
+	sort.Slice(poss, func(i, j int) bool { return poss[i] < poss[j] })
+	return poss
+}
+
+// Extract returns T[i...i+n)
+func (fm *FMIndex) Extract(i uint64, n uint64) []byte {
+	if i+n > fm.num || i+n < i {
+		panic(fmt.Sprintf("Extract: range [%d, %d) is out of bounds (len = %d)", i, i+n, fm.num))
+	}
+	// step back from the first sampled suffix at or after i+n, or the empty suffix
+	end := min(floor(i+n, fm.sampleRate)*fm.sampleRate, fm.num)
+	row := uint64(0)
+	if end%fm.sampleRate == 0 {
+		row = readUint64(fm.isa, end/fm.sampleRate)
+	}
+	out := make([]byte, n)
+	for pos := end; pos > i; pos-- {
+		var c uint32
+		row, c = fm.lf(row)
+		if pos <= i+n {
+			out[pos-1-i] = byte(c - 1)
+		}
+	}
+	return out
+}
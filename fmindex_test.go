@@ -0,0 +1,119 @@
+package rsdic
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSuffixArray(t *testing.T) {
+	Convey("When suffix arrays are built", t, func() {
+		texts := [][]byte{{}, []byte("a"), []byte("banana"), []byte("mmiissiissiippii"),
+			bytes.Repeat([]byte("ab"), 300), bytes.Repeat([]byte{0}, 100), bytes.Repeat([]byte{255}, 7)}
+		for n := 0; n < 50; n++ {
+			text := make([]byte, rand.Intn(2000))
+			for i := range text {
+				text[i] = "ab"[rand.Intn(2)]
+				if n%2 == 0 && i >= 10 && rand.Intn(8) != 0 {
+					text[i] = text[i-10]
+				}
+			}
+			texts = append(texts, text)
+		}
+		for _, text := range texts {
+			expected := make([]int32, len(text)+1)
+			for i := range expected {
+				expected[i] = int32(i)
+			}
+			sort.Slice(expected, func(i, j int) bool {
+				return bytes.Compare(text[expected[i]:], text[expected[j]:]) < 0
+			})
+			So(suffixArray(text), ShouldResemble, expected)
+		}
+	})
+}
+
+func TestFMIndex(t *testing.T) {
+	// a repetitive text over a small alphabet with a few other bytes
+	text := make([]byte, 10000)
+	for i := range text {
+		switch {
+		case i >= 500 && rand.Intn(10) != 0:
+			text[i] = text[i-500]
+		case rand.Intn(50) == 0:
+			text[i] = byte(rand.Intn(256))
+		default:
+			text[i] = "acgt"[rand.Intn(4)]
+		}
+	}
+	built, err := BuildFMIndex("test/fmindex", text, 16)
+	if err != nil {
+		panic(err)
+	}
+	defer built.Close()
+
+	locate := func(pattern []byte) []uint64 {
+		poss := []uint64{}
+		for i := 0; i+len(pattern) <= len(text); i++ {
+			if bytes.Equal(text[i:i+len(pattern)], pattern) {
+				poss = append(poss, uint64(i))
+			}
+		}
+		return poss
+	}
+	checkFMIndex := func(fm *FMIndex) {
+		So(fm.Len(), ShouldEqual, len(text))
+		for n := 0; n < 200; n++ {
+			i := rand.Intn(len(text))
+			pattern := text[i:min(i+2+rand.Intn(8), len(text))]
+			if n%4 == 0 {
+				pattern = append(append([]byte{}, pattern...), "acgt"[rand.Intn(4)])
+			}
+			poss := locate(pattern)
+			So(fm.Count(pattern), ShouldEqual, len(poss))
+			So(fm.Locate(pattern), ShouldResemble, poss)
+
+			l := uint64(rand.Intn(len(text) + 1))
+			m := uint64(rand.Intn(len(text)+1-int(l))) % 100
+			So(fm.Extract(l, m), ShouldResemble, text[l:l+m])
+		}
+		So(fm.Locate(text[:1]), ShouldResemble, locate(text[:1]))
+		So(fm.Count(nil), ShouldEqual, len(text)+1)
+		So(fm.Count([]byte("acgtX\x00")), ShouldEqual, len(locate([]byte("acgtX\x00"))))
+		So(fm.Extract(0, fm.Len()), ShouldResemble, text)
+		So(func() { fm.Extract(1, fm.Len()) }, ShouldPanic)
+	}
+
+	Convey("When an FM-index is built", t, func() {
+		checkFMIndex(built)
+	})
+
+	Convey("When an FM-index is opened", t, func() {
+		fm, err := OpenFMIndex("test/fmindex")
+		So(err, ShouldBeNil)
+		defer fm.Close()
+		checkFMIndex(fm)
+	})
+
+	Convey("When an FM-index has a small or no text", t, func() {
+		fm, err := BuildFMIndex("test/fmindex_small", []byte("abracadabra"), 3)
+		So(err, ShouldBeNil)
+		So(fm.Count([]byte("abra")), ShouldEqual, 2)
+		So(fm.Locate([]byte("a")), ShouldResemble, []uint64{0, 3, 5, 7, 10})
+		So(fm.Locate([]byte("abd")), ShouldBeEmpty)
+		So(string(fm.Extract(4, 7)), ShouldEqual, "cadabra")
+		So(fm.Close(), ShouldBeNil)
+
+		fm, err = BuildFMIndex("test/fmindex_small", nil, 3)
+		So(err, ShouldBeNil)
+		So(fm.Count([]byte("a")), ShouldEqual, 0)
+		So(fm.Extract(0, 0), ShouldBeEmpty)
+		So(fm.Close(), ShouldBeNil)
+
+		_, err = BuildFMIndex("test/fmindex_small", []byte("a"), 0)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -5,11 +5,11 @@ go 1.22.3
 require (
 	github.com/smartystreets/goconvey v1.8.1
 	github.com/ugorji/go/codec v1.2.12
+	golang.org/x/exp v0.0.0-20240604190554-fc45aab8b7f8
 )
 
 require (
 	github.com/gopherjs/gopherjs v1.17.2 // indirect
 	github.com/jtolds/gls v4.20.0+incompatible // indirect
 	github.com/smarty/assertions v1.15.0 // indirect
-	golang.org/x/exp v0.0.0-20240604190554-fc45aab8b7f8 // indirect
 )
@@ -1,11 +1,14 @@
 package rsdic
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"io"
 	"os"
 	"path"
 
+	"github.com/ugorji/go/codec"
 	"golang.org/x/exp/mmap"
 )
 
@@ -16,6 +19,10 @@ const (
 	SELECT_ONE_IND_FN   = "select_one_ind.bin"
 	SELECT_ZERO_IND_FN  = "select_zero_ind.bin"
 	RANK_SMALL_BLOCK_FN = "rank_small_block.bin"
+	RUN_BLOCK_FN        = "run_block.bin"
+
+	// the metadata of the structures built on RSDics in subdirectories
+	MANIFEST_FN = "manifest.bin"
 )
 
 type Readers struct {
@@ -25,6 +32,7 @@ type Readers struct {
 	selectOneReader  io.ReaderAt
 	selectZeroReader io.ReaderAt
 	rankSmallReader  io.ReaderAt
+	runReader        io.ReaderAt
 }
 
 type Writers struct {
@@ -34,6 +42,7 @@ type Writers struct {
 	selectOneWriter  io.Writer
 	selectZeroWriter io.Writer
 	rankSmallWriter  io.Writer
+	runWriter        io.Writer
 }
 
 func InitReaders(bitsPath string) (*Readers, error) {
@@ -67,6 +76,14 @@ func InitReaders(bitsPath string) (*Readers, error) {
 		return nil, err
 	}
 
+	// directories of format version 0 have no runs (See lblock.go)
+	var runReader io.ReaderAt = bytes.NewReader(nil)
+	if runFile, err := mmap.Open(path.Join(bitsPath, RUN_BLOCK_FN)); err == nil {
+		runReader = runFile
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
 	return &Readers{
 		bitsReader:       bitsReader,
 		pointerReader:    pointerReader,
@@ -74,6 +91,7 @@ func InitReaders(bitsPath string) (*Readers, error) {
 		selectOneReader:  selectOneReader,
 		selectZeroReader: selectZeroReader,
 		rankSmallReader:  rankSmallReader,
+		runReader:        runReader,
 	}, nil
 }
 
@@ -108,6 +126,11 @@ func InitWriters(bitsPath string) (*Writers, error) {
 		return nil, err
 	}
 
+	runWriter, err := os.Create(path.Join(bitsPath, RUN_BLOCK_FN))
+	if err != nil {
+		return nil, err
+	}
+
 	return &Writers{
 		bitsWriter:       writer,
 		pointerWriter:    pointerWriter,
@@ -115,6 +138,7 @@ func InitWriters(bitsPath string) (*Writers, error) {
 		selectOneWriter:  selectOneWriter,
 		selectZeroWriter: selectZeroWriter,
 		rankSmallWriter:  rankSmallWriter,
+		runWriter:        runWriter,
 	}, nil
 }
 
@@ -161,6 +185,26 @@ func (w *Writers) Close() error {
 		}
 	}
 
+	if closer, ok := w.runWriter.(io.Closer); ok {
+		err := closer.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Readers) Close() error {
+	for _, reader := range []io.ReaderAt{r.bitsReader, r.pointerReader, r.rankReader,
+		r.selectOneReader, r.selectZeroReader, r.rankSmallReader, r.runReader} {
+		if closer, ok := reader.(io.Closer); ok {
+			err := closer.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -205,3 +249,131 @@ func readUint8(r io.ReaderAt, pos uint64) uint8 {
 
 	return buf[0]
 }
+
+// readUint64s returns the values at [from, to) of r.
+func readUint64s(r io.ReaderAt, from uint64, to uint64) []uint64 {
+	if from >= to {
+		return nil
+	}
+	buf := readUint8s(r, from*8, to*8)
+	vals := make([]uint64, to-from)
+	for i := range vals {
+		vals[i] = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+	return vals
+}
+
+// readUint8s returns the bytes at [from, to) of r.
+func readUint8s(r io.ReaderAt, from uint64, to uint64) []uint8 {
+	if from >= to {
+		return nil
+	}
+	buf := make([]byte, to-from)
+	_, err := r.ReadAt(buf, int64(from))
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+func uint64sToBytes(vals []uint64) []byte {
+	buf := make([]byte, 0, len(vals)*8)
+	for _, val := range vals {
+		buf = binary.LittleEndian.AppendUint64(buf, val)
+	}
+	return buf
+}
+
+// rewriteTail overwrites the file name in dir with data from off, and truncates it after them.
+func rewriteTail(dir string, name string, off uint64, data []byte) error {
+	f, err := os.OpenFile(path.Join(dir, name), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, int64(off)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(int64(off) + int64(len(data))); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// seekEnd moves the writers to the ends of the files, after they are modified by rewriteTail.
+func (w *Writers) seekEnd() error {
+	for _, writer := range []io.Writer{w.bitsWriter, w.pointerWriter, w.rankWriter,
+		w.selectOneWriter, w.selectZeroWriter, w.rankSmallWriter, w.runWriter} {
+		if seeker, ok := writer.(io.Seeker); ok {
+			if _, err := seeker.Seek(0, io.SeekEnd); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeUint64File writes vals to the file name as little-endian 64-bit words.
+func writeUint64File(name string, vals []uint64) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, val := range vals {
+		appendUint64(w, val)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeManifest writes manifest to manifest.bin in dir in msgpack (as MarshalBinary).
+func writeManifest(dir string, manifest any) error {
+	var out []byte
+	var bh codec.MsgpackHandle
+	if err := codec.NewEncoderBytes(&out, &bh).Encode(manifest); err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(dir, MANIFEST_FN), out, 0666)
+}
+
+// readManifest reads manifest.bin in dir written by writeManifest into manifest.
+func readManifest(dir string, manifest any) error {
+	in, err := os.ReadFile(path.Join(dir, MANIFEST_FN))
+	if err != nil {
+		return err
+	}
+	var bh codec.MsgpackHandle
+	return codec.NewDecoderBytes(in, &bh).Decode(manifest)
+}
+
+// syncFiles commits the files of the RSDic at dir and the directory to stable storage.
+func syncFiles(dir string) error {
+	for _, name := range []string{BITS_FN, POINTER_BLOCK_FN, RANK_BLOCK_FN, SELECT_ONE_IND_FN,
+		SELECT_ZERO_IND_FN, RANK_SMALL_BLOCK_FN, RUN_BLOCK_FN} {
+		f, err := os.Open(path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
+
+// syncDir commits the entries of the directory dir to stable storage.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,318 @@
+package rsdic
+
+// Large blocks are stored in one of two ways, chosen automatically when a large
+// block is completed by PushBack.
+//
+// A large block whose bits are all zeros or all ones is a part of a run,
+// a maximal sequence of such large blocks with the same bit. A run is stored
+// as a single entry of run_block.bin, and its large blocks have no entries
+// in pointer.bin, rank_block.bin and rank_small_block.bin (nor codes in bits.bin).
+// Thus, long uniform regions cost O(1) space regardless of their length.
+//
+// Other large blocks are dense; the p-th dense large block has the p-th entry
+// in pointer.bin and rank_block.bin, and the entries [16p, 16p+16) in
+// rank_small_block.bin.
+//
+// The select samples are also stored only for dense large blocks: the j-th
+// sample of ones is the large block of the (4096j+1)-th one, and it is stored
+// in select_one_ind.bin only if that large block is dense (the same for zeros).
+// A run holds the numbers of samples in the runs before it, so that the
+// entry of the j-th sample after the run is j minus the samples in the runs up
+// to it (See selectStart). As a large block has less than 4096 bits, it has
+// at most one sample of each kind.
+//
+// The last large block is kept in memory until it is completed, since it is
+// not known yet how it will be stored.
+//
+// Directories written before runs were introduced (format version 0, whose
+// metadata has no version) have no run_block.bin, and all large blocks
+// including the last one have entries. They are read as if all large blocks
+// are dense, with the last one loaded into memory by LoadReader.
+
+// kRunBlockWords is the number of uint64 values per entry of run_block.bin
+// (start, end<<1|bit, rank, phys, oneSamples, zeroSamples).
+const kRunBlockWords = 6
+
+// runBlock is a run of large blocks whose bits are all the same.
+type runBlock struct {
+	start uint64 // the first large block of the run
+	end   uint64 // one past the last large block of the run
+	bit   bool   // the value of all bits in the run
+	rank  uint64 // the number of ones before the run
+	phys  uint64 // the number of dense large blocks before the run
+
+	oneSamples  uint64 // the number of select samples of ones in the runs before
+	zeroSamples uint64 // the number of select samples of zeros in the runs before
+}
+
+// lblock describes a logical large block, either a part of a run or a dense one.
+type lblock struct {
+	index   uint64 // the logical index of the large block
+	run     bool   // whether the large block is a part of a run
+	bit     bool   // the value of all bits if run
+	end     uint64 // the large block after the run (index+1 for dense blocks)
+	rank    uint64 // the number of ones before the large block
+	pointer uint64 // the position of the codes of the large block in bits (dense only)
+	phys    uint64 // the index among dense large blocks (if run, the number of dense blocks before)
+	pending bool   // whether this is the last large block whose small ranks are in memory
+	nextRun uint64 // the index of the first run after the large block
+}
+
+func uniformBlock(rankSBs []uint8) (bool, bool) {
+	for _, rankSB := range rankSBs {
+		if rankSB != rankSBs[0] {
+			return false, false
+		}
+	}
+	switch rankSBs[0] {
+	case 0:
+		return false, true
+	case kSmallBlockSize:
+		return true, true
+	}
+	return false, false
+}
+
+// writeLargeBlock stores the completed last large block,
+// either by extending or starting a run, or as a dense large block.
+func (rs *RSDic) writeLargeBlock() {
+	index := rs.rankBlockLength - 1
+	oneNum := uint64(0)
+	for _, rankSB := range rs.pendSmall {
+		oneNum += uint64(rankSB)
+	}
+	zeroRank := index*kLargeBlockSize - rs.pendRank
+	if bit, ok := uniformBlock(rs.pendSmall); ok {
+		if rs.hasOpenRun && rs.openRun.bit == bit {
+			rs.openRun.end++
+			return
+		}
+		rs.flushOpenRun()
+		// the samples before the run which are not stored are in the runs before
+		rs.openRun = runBlock{
+			start:       index,
+			end:         index + 1,
+			bit:         bit,
+			rank:        rs.pendRank,
+			phys:        rs.denseBlockLength,
+			oneSamples:  floor(rs.pendRank, kSelectBlockSize) - rs.selectOneLength,
+			zeroSamples: floor(zeroRank, kSelectBlockSize) - rs.selectZeroLength,
+		}
+		rs.hasOpenRun = true
+		return
+	}
+	rs.flushOpenRun()
+	appendUint64(rs.writer.rankWriter, rs.pendRank)
+	appendUint64(rs.writer.pointerWriter, rs.pendPointer)
+	for _, rankSB := range rs.pendSmall {
+		appendUint8(rs.writer.rankSmallWriter, rankSB)
+	}
+	if hasSample(rs.pendRank, rs.pendRank+oneNum) {
+		appendUint64(rs.writer.selectOneWriter, index)
+		rs.selectOneLength++
+	}
+	if hasSample(zeroRank, zeroRank+kLargeBlockSize-oneNum) {
+		appendUint64(rs.writer.selectZeroWriter, index)
+		rs.selectZeroLength++
+	}
+	rs.denseBlockLength++
+}
+
+// hasSample returns whether the occurrences of a bit with ranks [lo, hi)
+// include a select sample.
+func hasSample(lo uint64, hi uint64) bool {
+	return floor(hi, kSelectBlockSize) > floor(lo, kSelectBlockSize)
+}
+
+// setLegacy sets the fields of the runs and the last large block for the
+// metadata of format version 0, which has none of them.
+func (rs *RSDic) setLegacy() {
+	rs.legacy = true
+	rs.denseBlockLength = 0
+	if rs.rankBlockLength > 0 {
+		rs.denseBlockLength = rs.rankBlockLength - 1
+	}
+	rs.runBlockLength = 0
+	rs.openRun = runBlock{}
+	rs.hasOpenRun = false
+	// all samples are stored, including those of the last large block
+	rs.selectOneLength = floor(rs.oneNum, kSelectBlockSize)
+	rs.selectZeroLength = floor(rs.zeroNum, kSelectBlockSize)
+	rs.pendRank = 0
+	rs.pendPointer = 0
+	rs.pendSmall = rs.pendSmall[:0]
+	rs.sets = nil
+	rs.clears = nil
+}
+
+// loadLegacyLargeBlock loads the last large block of format version 0 from its entries.
+func (rs *RSDic) loadLegacyLargeBlock() {
+	if rs.rankBlockLength == 0 {
+		return
+	}
+	rs.pendRank = readUint64(rs.reader.rankReader, rs.denseBlockLength)
+	rs.pendPointer = readUint64(rs.reader.pointerReader, rs.denseBlockLength)
+	rs.pendSmall = append(rs.pendSmall[:0], readUint8s(rs.reader.rankSmallReader,
+		rs.denseBlockLength*kSmallBlockPerLargeBlock, rs.rankSmBlockLength)...)
+}
+
+// flushOpenRun writes the last run, which can no longer be extended, to run_block.bin.
+func (rs *RSDic) flushOpenRun() {
+	if !rs.hasOpenRun {
+		return
+	}
+	for _, val := range rs.openRun.words() {
+		appendUint64(rs.writer.runWriter, val)
+	}
+	rs.runBlockLength++
+	rs.openRun = runBlock{}
+	rs.hasOpenRun = false
+}
+
+// runNum returns the number of runs including the last one kept in memory.
+func (rs *RSDic) runNum() uint64 {
+	if rs.hasOpenRun {
+		return rs.runBlockLength + 1
+	}
+	return rs.runBlockLength
+}
+
+// words returns the entry of run_block.bin for run.
+func (run runBlock) words() []uint64 {
+	endBit := run.end << 1
+	if run.bit {
+		endBit |= 1
+	}
+	return []uint64{run.start, endBit, run.rank, run.phys, run.oneSamples, run.zeroSamples}
+}
+
+// bitRange returns the ranks [lo, hi) of the occurrences of bit in run.
+func (run runBlock) bitRange(bit bool) (uint64, uint64) {
+	lo := bitNum(run.rank, run.start*kLargeBlockSize, bit)
+	if run.bit != bit {
+		return lo, lo
+	}
+	return lo, lo + (run.end-run.start)*kLargeBlockSize
+}
+
+// samplesThrough returns the number of select samples of bit in the runs up to run.
+func (run runBlock) samplesThrough(bit bool) uint64 {
+	lo, hi := run.bitRange(bit)
+	if bit {
+		return run.oneSamples + floor(hi, kSelectBlockSize) - floor(lo, kSelectBlockSize)
+	}
+	return run.zeroSamples + floor(hi, kSelectBlockSize) - floor(lo, kSelectBlockSize)
+}
+
+func (rs *RSDic) runAt(i uint64) runBlock {
+	if i == rs.runBlockLength {
+		return rs.openRun
+	}
+	endBit := readUint64(rs.reader.runReader, i*kRunBlockWords+1)
+	return runBlock{
+		start: readUint64(rs.reader.runReader, i*kRunBlockWords),
+		end:   endBit >> 1,
+		bit:   endBit&1 == 1,
+		rank:  readUint64(rs.reader.runReader, i*kRunBlockWords+2),
+		phys:  readUint64(rs.reader.runReader, i*kRunBlockWords+3),
+
+		oneSamples:  readUint64(rs.reader.runReader, i*kRunBlockWords+4),
+		zeroSamples: readUint64(rs.reader.runReader, i*kRunBlockWords+5),
+	}
+}
+
+// runsFrom returns the runs in run_block.bin from the i-th one.
+func (rs *RSDic) runsFrom(i uint64) []runBlock {
+	runs := []runBlock{}
+	for ; i < rs.runBlockLength; i++ {
+		runs = append(runs, rs.runAt(i))
+	}
+	return runs
+}
+
+func runsToBytes(runs []runBlock) []byte {
+	vals := make([]uint64, 0, len(runs)*kRunBlockWords)
+	for _, run := range runs {
+		vals = append(vals, run.words()...)
+	}
+	return uint64sToBytes(vals)
+}
+
+func (rs *RSDic) runLBlock(index uint64, i uint64, run runBlock) lblock {
+	rank := run.rank
+	if run.bit {
+		rank += (index - run.start) * kLargeBlockSize
+	}
+	return lblock{
+		index:   index,
+		run:     true,
+		bit:     run.bit,
+		end:     run.end,
+		rank:    rank,
+		phys:    run.phys,
+		nextRun: i + 1,
+	}
+}
+
+func (rs *RSDic) denseLBlock(index uint64, phys uint64, nextRun uint64) lblock {
+	lb := lblock{
+		index:   index,
+		end:     index + 1,
+		phys:    phys,
+		nextRun: nextRun,
+	}
+	if phys == rs.denseBlockLength {
+		lb.pending = true
+		lb.rank = rs.pendRank
+		lb.pointer = rs.pendPointer
+	} else {
+		lb.rank = readUint64(rs.reader.rankReader, phys)
+		lb.pointer = readUint64(rs.reader.pointerReader, phys)
+	}
+	return lb
+}
+
+// lblockAt returns the large block of the given logical index.
+func (rs *RSDic) lblockAt(index uint64) lblock {
+	// find the number of runs starting at or before index
+	lo, hi := uint64(0), rs.runNum()
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if rs.runAt(mid).start <= index {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo == 0 {
+		return rs.denseLBlock(index, index, 0)
+	}
+	run := rs.runAt(lo - 1)
+	if index < run.end {
+		return rs.runLBlock(index, lo-1, run)
+	}
+	return rs.denseLBlock(index, index-(run.end-run.phys), lo)
+}
+
+// nextLBlock returns the large block following lb (i.e. the one at lb.end),
+// which must exist.
+func (rs *RSDic) nextLBlock(lb lblock) lblock {
+	if lb.nextRun < rs.runNum() {
+		if run := rs.runAt(lb.nextRun); run.start == lb.end {
+			return rs.runLBlock(lb.end, lb.nextRun, run)
+		}
+	}
+	phys := lb.phys
+	if !lb.run {
+		phys++
+	}
+	return rs.denseLBlock(lb.end, phys, lb.nextRun)
+}
+
+// smallRank returns the number of ones in the i-th small block of the dense large block lb.
+func (rs *RSDic) smallRank(lb lblock, i uint64) uint8 {
+	if lb.pending {
+		return rs.pendSmall[i]
+	}
+	return readUint8(rs.reader.rankSmallReader, lb.phys*kSmallBlockPerLargeBlock+i)
+}
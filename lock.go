@@ -0,0 +1,132 @@
+package rsdic
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Directory locking
+//
+// LoadWriter truncates the files of the directory, and the metadata of a
+// directory being written is only in memory, so a directory must not be
+// written by two processes, nor read by a process while written by another.
+// An advisory lock (flock(2)) on the directory itself enforces this:
+// LoadWriter takes it exclusively and LoadReader takes it shared, failing with
+// ErrLocked instead of waiting. CloseWriter and CloseReader release it.
+// As the directory is opened read-only and no lock file is created, readers
+// work on read-only directories, and if the directory can't be opened for the
+// lock, LoadReader goes on without it.
+//
+// flock locks are held per open file, so the lock is held once per process
+// and directory, and shared by the RSDics of the process on the directory
+// (e.g. a writer and its reader, or snapshots); among them, at most one may
+// have a writer loaded, and only while none has a reader loaded, since the
+// writer would truncate the files they have mapped. A reader may be loaded
+// after the writer, as PushBack only appends to the files. On platforms
+// without flock, only the locking within the process is done.
+
+// ErrLocked is returned (wrapped) by LoadWriter and LoadReader when the
+// directory is locked by another writer, and by LoadWriter when it is read.
+var ErrLocked = errors.New("rsdic: directory is locked")
+
+// dirLock is the lock of a directory held by this process.
+type dirLock struct {
+	f       *os.File
+	readers int
+	writers int
+}
+
+var dirLocks = struct {
+	sync.Mutex
+	m map[string]*dirLock
+}{m: map[string]*dirLock{}}
+
+func lockKey(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Clean(abs), nil
+}
+
+// lockDir takes the lock of dir for a writer (exclusive) or a reader (shared),
+// and returns whether it is taken, which is false only for a reader when dir
+// can't be opened for the lock.
+func lockDir(dir string, write bool) (bool, error) {
+	key, err := lockKey(dir)
+	if err != nil {
+		return false, err
+	}
+	dirLocks.Lock()
+	defer dirLocks.Unlock()
+	lock := dirLocks.m[key]
+	if lock == nil {
+		f, err := os.Open(dir)
+		if err != nil {
+			if write {
+				return false, err
+			}
+			return false, nil
+		}
+		lock = &dirLock{f: f}
+	}
+	held := lock.readers+lock.writers > 0
+	switch {
+	case write && lock.writers > 0:
+		return false, fmt.Errorf("%w: %s already has a writer in this process", ErrLocked, dir)
+	case write && lock.readers > 0:
+		return false, fmt.Errorf("%w: %s is read in this process", ErrLocked, dir)
+	case write:
+		if err := flock(lock.f, true); err != nil {
+			if !held {
+				lock.f.Close()
+			} else {
+				// a failed conversion may have released the shared lock
+				flock(lock.f, false)
+			}
+			return false, fmt.Errorf("%w: %s is used by another process (%v)", ErrLocked, dir, err)
+		}
+		lock.writers++
+	default:
+		if !held {
+			if err := flock(lock.f, false); err != nil {
+				lock.f.Close()
+				return false, fmt.Errorf("%w: %s has a writer in another process (%v)", ErrLocked, dir, err)
+			}
+		}
+		lock.readers++
+	}
+	dirLocks.m[key] = lock
+	return true, nil
+}
+
+// unlockDir releases the lock of dir taken by lockDir.
+func unlockDir(dir string, write bool) error {
+	key, err := lockKey(dir)
+	if err != nil {
+		return err
+	}
+	dirLocks.Lock()
+	defer dirLocks.Unlock()
+	lock := dirLocks.m[key]
+	if lock == nil {
+		return nil
+	}
+	if write {
+		lock.writers--
+	} else {
+		lock.readers--
+	}
+	if lock.readers+lock.writers > 0 {
+		if write && lock.writers == 0 {
+			// keep the lock shared for the remaining readers
+			return flock(lock.f, false)
+		}
+		return nil
+	}
+	delete(dirLocks.m, key)
+	return lock.f.Close() // which releases the lock
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package rsdic
+
+import "os"
+
+// flock does nothing on platforms without flock(2).
+func flock(f *os.File, exclusive bool) error {
+	return nil
+}
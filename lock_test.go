@@ -0,0 +1,106 @@
+package rsdic
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLock(t *testing.T) {
+	os.MkdirAll("test/locking", 0777)
+	// a lock taken through another open file behaves as one of another process
+	otherLock := func(exclusive bool) *os.File {
+		f, err := os.Open("test/locking")
+		if err != nil {
+			panic(err)
+		}
+		if err := flock(f, exclusive); err != nil {
+			panic(err)
+		}
+		return f
+	}
+
+	Convey("When a directory is written by a process", t, func() {
+		rsd, err := New("test/locking")
+		So(err, ShouldBeNil)
+		So(rsd.LoadWriter(), ShouldBeNil)
+		rsd.PushBack(true)
+
+		other, err := New("test/locking")
+		So(err, ShouldBeNil)
+		err = other.LoadWriter()
+		So(errors.Is(err, ErrLocked), ShouldBeTrue)
+		So(err.Error(), ShouldContainSubstring, "already has a writer")
+		So(other.LoadReader(), ShouldBeNil) // readers in the same process share the lock
+		So(other.CloseReader(), ShouldBeNil)
+
+		f, err := os.Open("test/locking")
+		So(err, ShouldBeNil)
+		So(flock(f, false), ShouldNotBeNil)
+		f.Close()
+
+		So(rsd.LoadReader(), ShouldBeNil)
+		So(rsd.CloseWriter(), ShouldBeNil)
+		// the lock is kept shared for the reader
+		f = otherLock(false)
+		f.Close()
+		So(rsd.Bit(0), ShouldBeTrue)
+		So(rsd.CloseReader(), ShouldBeNil)
+		f = otherLock(true)
+		f.Close()
+	})
+
+	Convey("When a directory read in this process is the output of a builder", t, func() {
+		orig := runBits(3)
+		_, a := initBitVectorAt("test/locking/a", orig)
+		defer a.CloseReader()
+		_, b := initBitVectorAt("test/locking/b", orig)
+		defer b.CloseReader()
+		_, err := And(a, b, a.path)
+		So(err, ShouldNotBeNil)
+		_, err = Not(b, "test/locking/../locking/b")
+		So(err, ShouldNotBeNil)
+		_, err = BuildFromReader(a.path, bytes.NewReader(packBits(orig)), uint64(len(orig)))
+		So(errors.Is(err, ErrLocked), ShouldBeTrue)
+		So(err.Error(), ShouldContainSubstring, "read in this process")
+		checkRSDic(a, orig)
+		checkRSDic(b, orig)
+	})
+
+	Convey("When a directory is used by another process", t, func() {
+		f := otherLock(false)
+		rsd, err := New("test/locking")
+		So(err, ShouldBeNil)
+		err = rsd.LoadWriter()
+		So(errors.Is(err, ErrLocked), ShouldBeTrue)
+		So(err.Error(), ShouldContainSubstring, "another process")
+		So(rsd.LoadReader(), ShouldBeNil)
+		So(errors.Is(rsd.LoadWriter(), ErrLocked), ShouldBeTrue)
+		So(rsd.CloseReader(), ShouldBeNil)
+		f.Close()
+
+		f = otherLock(true)
+		err = rsd.LoadReader()
+		So(errors.Is(err, ErrLocked), ShouldBeTrue)
+		So(err.Error(), ShouldContainSubstring, "writer in another process")
+		f.Close()
+		So(rsd.LoadReader(), ShouldBeNil)
+		So(rsd.CloseReader(), ShouldBeNil)
+	})
+
+	Convey("When a directory is locked for a reader", t, func() {
+		before, err := os.ReadDir("test/locking")
+		So(err, ShouldBeNil)
+		rsd, err := New("test/locking")
+		So(err, ShouldBeNil)
+		So(rsd.LoadReader(), ShouldBeNil)
+		// no lock file is created, so that read-only directories can be read
+		after, err := os.ReadDir("test/locking")
+		So(err, ShouldBeNil)
+		So(len(after), ShouldEqual, len(before))
+		So(rsd.CloseReader(), ShouldBeNil)
+	})
+}
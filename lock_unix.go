@@ -0,0 +1,18 @@
+//go:build unix
+
+package rsdic
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock takes an exclusive or shared lock of f without waiting,
+// converting the lock already held.
+func flock(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	return syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+}
@@ -0,0 +1,250 @@
+package rsdic
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// LOUDS represents an ordinal tree of num nodes by the level-order unary
+// degree sequence [1]. The nodes are numbered 0...num in the breadth-first
+// order, where the root is 0 and the children of a node are numbered in order.
+//
+// The bit string is 10 (for a super root above the root) followed by
+// 1^d 0 for each node of degree d in the breadth-first order, so that the
+// v-th one stands for the node v, and the children of the node v are the
+// ones after the (v+1)-th zero. It is stored as an RSDic in the subdirectory
+// louds of the directory, and its metadata in manifest.bin. Each navigation
+// takes a constant number of operations of the RSDic.
+//
+// The navigations return num for a missing node (e.g. Parent of the root),
+// and panic for a node out of bounds. As the queries don't modify it, LOUDS
+// is safe for concurrent queries.
+//
+// [1] "Space-efficient Static Trees and Graphs", Guy Jacobson, FOCS 1989
+type LOUDS struct {
+	path string
+	num  uint64
+	bits *RSDic
+}
+
+// loudsManifest is the content of manifest.bin.
+type loudsManifest struct {
+	Num  uint64
+	Bits []byte // MarshalBinary of the RSDic
+}
+
+const LOUDS_DIR = "louds"
+
+// BuildLOUDS returns a new LOUDS at dir of the tree whose degrees are given in
+// the breadth-first order by next, with its bits written and loaded for reading.
+// next is called until all nodes are given, and its second result is false if
+// there are no more nodes, which is an error unless no node is given.
+func BuildLOUDS(dir string, next func() (degree uint64, ok bool)) (*LOUDS, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	out, err := newOpOutput(path.Join(dir, LOUDS_DIR))
+	if err != nil {
+		return nil, err
+	}
+	w := &bitWriter{out: out}
+	num := uint64(0)
+	for pending := uint64(1); pending > 0; pending-- {
+		degree, ok := next()
+		if !ok {
+			if num == 0 {
+				break
+			}
+			removeOutput(out)
+			return nil, fmt.Errorf("rsdic: tree ended with %d nodes not given", pending)
+		}
+		if num == 0 {
+			w.push(true)
+			w.push(false)
+		}
+		for i := uint64(0); i < degree; i++ {
+			w.push(true)
+		}
+		w.push(false)
+		pending += degree
+		num++
+	}
+	w.flush()
+	if err := closeOpOutput(out); err != nil {
+		return nil, err
+	}
+	lt := &LOUDS{path: dir, num: num, bits: out}
+	manifest := loudsManifest{Num: num}
+	meta, err := out.MarshalBinary()
+	if err == nil {
+		manifest.Bits = meta
+		err = writeManifest(dir, manifest)
+	}
+	if err != nil {
+		lt.Close()
+		return nil, err
+	}
+	return lt, nil
+}
+
+// BuildLOUDSFromEdges returns a new LOUDS at dir of the tree given by edges of
+// (parent, child) IDs, where the children of a node are ordered as in edges.
+// The root is the only parent which is not a child. It also returns the IDs of
+// the nodes, i.e. the node v of the LOUDS is ids[v]. An empty edges gives an
+// empty tree.
+func BuildLOUDSFromEdges(dir string, edges [][2]uint64) (*LOUDS, []uint64, error) {
+	children, root, err := edgeChildren(edges)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := []uint64{}
+	if len(edges) > 0 {
+		ids = append(ids, root)
+		for v := 0; v < len(ids); v++ {
+			ids = append(ids, children[ids[v]]...)
+		}
+	}
+	v := 0
+	lt, err := BuildLOUDS(dir, func() (uint64, bool) {
+		if v == len(ids) {
+			return 0, false
+		}
+		v++
+		return uint64(len(children[ids[v-1]])), true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return lt, ids, nil
+}
+
+// edgeChildren returns the children of each node in the order of edges of
+// (parent, child) IDs, and the root, checking that edges form a tree.
+func edgeChildren(edges [][2]uint64) (map[uint64][]uint64, uint64, error) {
+	children := map[uint64][]uint64{}
+	hasParent := map[uint64]bool{}
+	for _, edge := range edges {
+		if hasParent[edge[1]] {
+			return nil, 0, fmt.Errorf("rsdic: node %d has more than one parent", edge[1])
+		}
+		hasParent[edge[1]] = true
+		children[edge[0]] = append(children[edge[0]], edge[1])
+	}
+	if len(edges) == 0 {
+		return children, 0, nil
+	}
+	roots := []uint64{}
+	for _, edge := range edges {
+		if !hasParent[edge[0]] && (len(roots) == 0 || roots[0] != edge[0]) {
+			roots = append(roots, edge[0])
+		}
+	}
+	if len(roots) == 0 {
+		return nil, 0, fmt.Errorf("rsdic: edges have no root")
+	}
+	if len(roots) > 1 {
+		return nil, 0, fmt.Errorf("rsdic: edges have more than one root (%d and %d)", roots[0], roots[1])
+	}
+	// the nodes are visited at most once, as they have at most one parent
+	reached := 1
+	for stack := []uint64{roots[0]}; len(stack) > 0; {
+		cs := children[stack[len(stack)-1]]
+		stack = append(stack[:len(stack)-1], cs...)
+		reached += len(cs)
+	}
+	if reached != len(edges)+1 {
+		return nil, 0, fmt.Errorf("rsdic: %d nodes are not reachable from the root %d", len(edges)+1-reached, roots[0])
+	}
+	return children, roots[0], nil
+}
+
+// OpenLOUDS loads the LOUDS at dir written by BuildLOUDS.
+func OpenLOUDS(dir string) (*LOUDS, error) {
+	var manifest loudsManifest
+	if err := readManifest(dir, &manifest); err != nil {
+		return nil, err
+	}
+	bits, err := New(path.Join(dir, LOUDS_DIR))
+	if err != nil {
+		return nil, err
+	}
+	if err := bits.UnmarshalBinary(manifest.Bits); err != nil {
+		return nil, err
+	}
+	if bits.Num() != 2*manifest.Num+min(manifest.Num, 1) {
+		return nil, fmt.Errorf("rsdic: bits of %s have length %d for %d nodes", dir, bits.Num(), manifest.Num)
+	}
+	if err := bits.LoadReader(); err != nil {
+		return nil, err
+	}
+	return &LOUDS{path: dir, num: manifest.Num, bits: bits}, nil
+}
+
+// Close releases the reader of the bits.
+func (lt *LOUDS) Close() error {
+	return lt.bits.CloseReader()
+}
+
+// Num returns the number of nodes
+func (lt *LOUDS) Num() uint64 {
+	return lt.num
+}
+
+func (lt *LOUDS) checkNode(name string, v uint64) {
+	if v >= lt.num {
+		panic(fmt.Sprintf("%s: node %d is out of bounds (num = %d)", name, v, lt.num))
+	}
+}
+
+// Degree returns the number of children of v
+func (lt *LOUDS) Degree(v uint64) uint64 {
+	lt.checkNode("Degree", v)
+	return lt.bits.Select0(v+1) - lt.bits.Select0(v) - 1
+}
+
+// IsLeaf returns true if v has no children
+func (lt *LOUDS) IsLeaf(v uint64) bool {
+	lt.checkNode("IsLeaf", v)
+	return !lt.bits.Bit(lt.bits.Select0(v) + 1)
+}
+
+// FirstChild returns the first child of v, or num if v is a leaf
+func (lt *LOUDS) FirstChild(v uint64) uint64 {
+	lt.checkNode("FirstChild", v)
+	start := lt.bits.Select0(v) + 1
+	if !lt.bits.Bit(start) {
+		return lt.num
+	}
+	// the number of ones before start, as v+1 zeros are before it
+	return start - v - 1
+}
+
+// Child returns the (i+1)-th child of v, or num if v has i or less children
+func (lt *LOUDS) Child(v uint64, i uint64) uint64 {
+	lt.checkNode("Child", v)
+	start := lt.bits.Select0(v) + 1
+	if i >= lt.bits.Select0(v+1)-start {
+		return lt.num
+	}
+	return start - v - 1 + i
+}
+
+// NextSibling returns the next child of the parent of v, or num if v is the last one
+func (lt *LOUDS) NextSibling(v uint64) uint64 {
+	lt.checkNode("NextSibling", v)
+	if v == 0 || !lt.bits.Bit(lt.bits.Select1(v)+1) {
+		return lt.num
+	}
+	return v + 1
+}
+
+// Parent returns the parent of v, or num if v is the root
+func (lt *LOUDS) Parent(v uint64) uint64 {
+	lt.checkNode("Parent", v)
+	if v == 0 {
+		return lt.num
+	}
+	// the number of zeros before the v-th one, less the one of the super root
+	return lt.bits.Select1(v) - v - 1
+}
@@ -0,0 +1,113 @@
+package rsdic
+
+import (
+	"math/rand"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLOUDS(t *testing.T) {
+	// a random tree with shuffled IDs, whose node i is attached to an earlier one
+	ids := rand.Perm(5000)
+	edges := [][2]uint64{}
+	for i := 1; i < len(ids); i++ {
+		parent := rand.Intn(i)
+		if rand.Intn(2) == 0 {
+			parent = i - 1 - rand.Intn(min(i, 3))
+		}
+		edges = append(edges, [2]uint64{uint64(ids[parent]), uint64(ids[i])})
+	}
+	children := map[uint64][]uint64{}
+	for _, edge := range edges {
+		children[edge[0]] = append(children[edge[0]], edge[1])
+	}
+	built, order, err := BuildLOUDSFromEdges("test/louds", edges)
+	if err != nil {
+		panic(err)
+	}
+	defer built.Close()
+
+	checkLOUDS := func(lt *LOUDS) {
+		So(lt.Num(), ShouldEqual, len(ids))
+		So(order[0], ShouldEqual, ids[0])
+		node := map[uint64]uint64{}
+		for v, id := range order {
+			node[id] = uint64(v)
+		}
+		for v := uint64(0); v < lt.Num(); v++ {
+			cs := children[order[v]]
+			So(lt.Degree(v), ShouldEqual, len(cs))
+			So(lt.IsLeaf(v), ShouldEqual, len(cs) == 0)
+			if len(cs) == 0 {
+				So(lt.FirstChild(v), ShouldEqual, lt.Num())
+			} else {
+				So(lt.FirstChild(v), ShouldEqual, node[cs[0]])
+			}
+			for i, c := range cs {
+				So(lt.Child(v, uint64(i)), ShouldEqual, node[c])
+				So(lt.Parent(node[c]), ShouldEqual, v)
+				if i+1 < len(cs) {
+					So(lt.NextSibling(node[c]), ShouldEqual, node[cs[i+1]])
+				} else {
+					So(lt.NextSibling(node[c]), ShouldEqual, lt.Num())
+				}
+			}
+			So(lt.Child(v, uint64(len(cs))), ShouldEqual, lt.Num())
+		}
+		So(lt.Parent(0), ShouldEqual, lt.Num())
+		So(lt.NextSibling(0), ShouldEqual, lt.Num())
+		So(func() { lt.Parent(lt.Num()) }, ShouldPanic)
+	}
+
+	Convey("When a LOUDS is built from edges", t, func() {
+		checkLOUDS(built)
+	})
+
+	Convey("When a LOUDS is opened", t, func() {
+		lt, err := OpenLOUDS("test/louds")
+		So(err, ShouldBeNil)
+		defer lt.Close()
+		checkLOUDS(lt)
+	})
+
+	Convey("When a LOUDS is built from degrees", t, func() {
+		// 0 -> (1, 2, 3), 1 -> (4), 3 -> (5, 6)
+		degrees := []uint64{3, 1, 0, 2, 0, 0, 0}
+		next := func() (uint64, bool) {
+			if len(degrees) == 0 {
+				return 0, false
+			}
+			degree := degrees[0]
+			degrees = degrees[1:]
+			return degree, true
+		}
+		lt, err := BuildLOUDS("test/louds_small", next)
+		So(err, ShouldBeNil)
+		So(lt.Num(), ShouldEqual, 7)
+		So(lt.Child(3, 1), ShouldEqual, 6)
+		So(lt.Parent(4), ShouldEqual, 1)
+		So(lt.NextSibling(3), ShouldEqual, 7)
+		So(lt.Close(), ShouldBeNil)
+
+		degrees = []uint64{2, 1}
+		_, err = BuildLOUDS("test/louds_small", next)
+		So(err, ShouldNotBeNil)
+
+		lt, err = BuildLOUDS("test/louds_small", next)
+		So(err, ShouldBeNil)
+		So(lt.Num(), ShouldEqual, 0)
+		So(lt.Close(), ShouldBeNil)
+	})
+
+	Convey("When edges are not a tree", t, func() {
+		_, _, err := BuildLOUDSFromEdges("test/louds_small", [][2]uint64{{1, 2}, {3, 2}})
+		So(err, ShouldNotBeNil)
+		_, _, err = BuildLOUDSFromEdges("test/louds_small", [][2]uint64{{1, 2}, {3, 4}})
+		So(err, ShouldNotBeNil)
+		_, _, err = BuildLOUDSFromEdges("test/louds_small", [][2]uint64{{1, 2}, {2, 3}, {3, 2}})
+		So(err, ShouldNotBeNil)
+		_, _, err = BuildLOUDSFromEdges("test/louds_small", [][2]uint64{{1, 2}, {2, 3}, {4, 5}, {5, 4}})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,336 @@
+package rsdic
+
+import (
+	"context"
+	"fmt"
+)
+
+// Logical operations between RSDics of the same length.
+//
+// The inputs are read small block by small block. A block with no ones or
+// only ones (including those in runs) is known from its rank without decoding,
+// and when it alone determines the result (e.g. a zero block for And), the
+// corresponding block of the other input is skipped without decoding either.
+// The result is built as by PushBack, so that its uniform regions are stored
+// as runs again, and is returned with its writer closed and its reader loaded.
+
+// And returns a new RSDic at outPath representing a AND b.
+func And(a, b *RSDic, outPath string) (*RSDic, error) {
+	return AndContext(context.Background(), a, b, outPath)
+}
+
+// AndContext is And with cancellation and progress (See context.go).
+func AndContext(ctx context.Context, a, b *RSDic, outPath string) (*RSDic, error) {
+	return logicalOp(ctx, a, b, outPath, func(x, y uint64) uint64 { return x & y })
+}
+
+// Or returns a new RSDic at outPath representing a OR b.
+func Or(a, b *RSDic, outPath string) (*RSDic, error) {
+	return OrContext(context.Background(), a, b, outPath)
+}
+
+// OrContext is Or with cancellation and progress (See context.go).
+func OrContext(ctx context.Context, a, b *RSDic, outPath string) (*RSDic, error) {
+	return logicalOp(ctx, a, b, outPath, func(x, y uint64) uint64 { return x | y })
+}
+
+// Xor returns a new RSDic at outPath representing a XOR b.
+func Xor(a, b *RSDic, outPath string) (*RSDic, error) {
+	return XorContext(context.Background(), a, b, outPath)
+}
+
+// XorContext is Xor with cancellation and progress (See context.go).
+func XorContext(ctx context.Context, a, b *RSDic, outPath string) (*RSDic, error) {
+	return logicalOp(ctx, a, b, outPath, func(x, y uint64) uint64 { return x ^ y })
+}
+
+// AndNot returns a new RSDic at outPath representing a AND (NOT b).
+func AndNot(a, b *RSDic, outPath string) (*RSDic, error) {
+	return AndNotContext(context.Background(), a, b, outPath)
+}
+
+// AndNotContext is AndNot with cancellation and progress (See context.go).
+func AndNotContext(ctx context.Context, a, b *RSDic, outPath string) (*RSDic, error) {
+	return logicalOp(ctx, a, b, outPath, func(x, y uint64) uint64 { return x &^ y })
+}
+
+// Not returns a new RSDic at outPath representing NOT a.
+func Not(a *RSDic, outPath string) (*RSDic, error) {
+	return NotContext(context.Background(), a, outPath)
+}
+
+// NotContext is Not with cancellation and progress (See context.go).
+func NotContext(ctx context.Context, a *RSDic, outPath string) (*RSDic, error) {
+	out, err := newOpOutput(outPath, a)
+	if err != nil {
+		return nil, err
+	}
+	t := newTracker(ctx, a.num)
+	wr := a.newWordReader(0)
+	for pos := uint64(0); pos < a.num; pos += kSmallBlockSize {
+		n := min(kSmallBlockSize, a.num-pos)
+		out.pushWord(^wr.next(), n)
+		if err := t.add(n); err != nil {
+			removeOutput(out)
+			return nil, err
+		}
+	}
+	if err := closeOpOutput(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func logicalOp(ctx context.Context, a, b *RSDic, outPath string, op func(x, y uint64) uint64) (*RSDic, error) {
+	if a.num != b.num {
+		return nil, fmt.Errorf("rsdic: lengths differ (%d and %d)", a.num, b.num)
+	}
+	out, err := newOpOutput(outPath, a, b)
+	if err != nil {
+		return nil, err
+	}
+	t := newTracker(ctx, a.num)
+	wa := a.newWordReader(0)
+	wb := b.newWordReader(0)
+	for pos := uint64(0); pos < a.num; pos += kSmallBlockSize {
+		n := min(kSmallBlockSize, a.num-pos)
+		out.pushWord(opWord(wa, wb, op), n)
+		if err := t.add(n); err != nil {
+			removeOutput(out)
+			return nil, err
+		}
+	}
+	if err := closeOpOutput(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// opWord returns op of the current small blocks of wa and wb, and moves both to the next ones.
+func opWord(wa, wb *wordReader, op func(x, y uint64) uint64) uint64 {
+	rankA, rankB := wa.rank(), wb.rank()
+	// a bitwise op doesn't depend on y if it gives the same for y = 0 and y = ^0
+	if x, ok := uniformWord(rankA); ok && op(x, 0) == op(x, ^uint64(0)) {
+		wa.skip()
+		wb.skip()
+		return op(x, 0)
+	}
+	if y, ok := uniformWord(rankB); ok && op(0, y) == op(^uint64(0), y) {
+		wa.skip()
+		wb.skip()
+		return op(0, y)
+	}
+	return op(wa.decode(), wb.decode())
+}
+
+// uniformWord returns the bits of a small block whose number of ones is rankSB,
+// if they are all the same.
+func uniformWord(rankSB uint8) (uint64, bool) {
+	switch rankSB {
+	case 0:
+		return 0, true
+	case kSmallBlockSize:
+		return ^uint64(0), true
+	}
+	return 0, false
+}
+
+// AndCount returns the number of ones in a AND b without building it.
+func AndCount(a, b *RSDic) (uint64, error) {
+	return AndCountContext(context.Background(), a, b)
+}
+
+// AndCountContext is AndCount with cancellation and progress (See context.go).
+func AndCountContext(ctx context.Context, a, b *RSDic) (uint64, error) {
+	counts, err := opCounts(ctx, a, b, func(x, y uint64) uint64 { return x & y })
+	if err != nil {
+		return 0, err
+	}
+	return counts[0], nil
+}
+
+// OrCount returns the number of ones in a OR b without building it.
+func OrCount(a, b *RSDic) (uint64, error) {
+	return OrCountContext(context.Background(), a, b)
+}
+
+// OrCountContext is OrCount with cancellation and progress (See context.go).
+func OrCountContext(ctx context.Context, a, b *RSDic) (uint64, error) {
+	counts, err := opCounts(ctx, a, b, func(x, y uint64) uint64 { return x | y })
+	if err != nil {
+		return 0, err
+	}
+	return counts[0], nil
+}
+
+// XorCount returns the number of ones in a XOR b without building it.
+func XorCount(a, b *RSDic) (uint64, error) {
+	return XorCountContext(context.Background(), a, b)
+}
+
+// XorCountContext is XorCount with cancellation and progress (See context.go).
+func XorCountContext(ctx context.Context, a, b *RSDic) (uint64, error) {
+	counts, err := opCounts(ctx, a, b, func(x, y uint64) uint64 { return x ^ y })
+	if err != nil {
+		return 0, err
+	}
+	return counts[0], nil
+}
+
+// Jaccard returns the Jaccard similarity |A AND B| / |A OR B| of the sets of
+// positions of ones in a and b, or 1 if neither has ones.
+func Jaccard(a, b *RSDic) (float64, error) {
+	return JaccardContext(context.Background(), a, b)
+}
+
+// JaccardContext is Jaccard with cancellation and progress (See context.go).
+func JaccardContext(ctx context.Context, a, b *RSDic) (float64, error) {
+	counts, err := opCounts(ctx, a, b,
+		func(x, y uint64) uint64 { return x & y },
+		func(x, y uint64) uint64 { return x | y })
+	if err != nil {
+		return 0, err
+	}
+	if counts[1] == 0 {
+		return 1, nil
+	}
+	return float64(counts[0]) / float64(counts[1]), nil
+}
+
+// opCounts returns the number of ones in op(a, b) for each of ops, which must map
+// zeros to zeros (so that the bits after the end are not counted).
+// Overlapping runs are counted at once, a pair of small blocks is counted from
+// their ranks when either is uniform, and only the other pairs are decoded.
+func opCounts(ctx context.Context, a, b *RSDic, ops ...func(x, y uint64) uint64) ([]uint64, error) {
+	if a.num != b.num {
+		return nil, fmt.Errorf("rsdic: lengths differ (%d and %d)", a.num, b.num)
+	}
+	counts := make([]uint64, len(ops))
+	t := newTracker(ctx, a.num)
+	wa := a.newWordReader(0)
+	wb := b.newWordReader(0)
+	blockNum := floor(a.num, kSmallBlockSize)
+	for sblock := uint64(0); sblock < blockNum; {
+		rankA, rankB := wa.rank(), wb.rank()
+		x, uniformA := uniformWord(rankA)
+		y, uniformB := uniformWord(rankB)
+		n := min(wa.runLeft(), wb.runLeft())
+		if n > 0 {
+			for i, op := range ops {
+				counts[i] += uint64(popCount(op(x, y))) * n
+			}
+			wa.skipRun(n)
+			wb.skipRun(n)
+		} else {
+			n = 1
+			switch {
+			case uniformA:
+				for i, op := range ops {
+					counts[i] += uniformCount(func(y uint64) uint64 { return op(x, y) }, rankB)
+				}
+				wa.skip()
+				wb.skip()
+			case uniformB:
+				for i, op := range ops {
+					counts[i] += uniformCount(func(x uint64) uint64 { return op(x, y) }, rankA)
+				}
+				wa.skip()
+				wb.skip()
+			default:
+				x, y = wa.decode(), wb.decode()
+				for i, op := range ops {
+					counts[i] += uint64(popCount(op(x, y)))
+				}
+			}
+		}
+		sblock += n
+		if err := t.add(min(sblock*kSmallBlockSize, a.num) - (sblock-n)*kSmallBlockSize); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// uniformCount returns the number of ones in f(y) for a small block y with rankSB ones,
+// where f applies the same function to every bit.
+func uniformCount(f func(y uint64) uint64, rankSB uint8) uint64 {
+	zero, one := f(0), f(^uint64(0))
+	switch {
+	case zero == one:
+		return uint64(popCount(zero))
+	case zero == 0:
+		return uint64(rankSB)
+	default:
+		return uint64(kSmallBlockSize - rankSB)
+	}
+}
+
+// newOpOutput returns a new RSDic at outPath with its writer loaded. outPath must
+// not be the path of any of inputs, whose files the writer would truncate.
+func newOpOutput(outPath string, inputs ...*RSDic) (*RSDic, error) {
+	key, err := lockKey(outPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, in := range inputs {
+		if inKey, err := lockKey(in.path); err == nil && inKey == key {
+			return nil, fmt.Errorf("rsdic: output %s is also an input", outPath)
+		}
+	}
+	out, err := New(outPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := out.LoadWriter(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func closeOpOutput(out *RSDic) error {
+	if err := out.CloseWriter(); err != nil {
+		return err
+	}
+	return out.LoadReader()
+}
+
+// bitWriter pushes bits back to an RSDic a word at a time; flush pushes the rest.
+type bitWriter struct {
+	out   *RSDic
+	word  uint64
+	nbits uint64
+}
+
+func (w *bitWriter) push(bit bool) {
+	if bit {
+		w.word |= 1 << w.nbits
+	}
+	w.nbits++
+	if w.nbits == kSmallBlockSize {
+		w.flush()
+	}
+}
+
+func (w *bitWriter) flush() {
+	if w.nbits > 0 {
+		w.out.pushWord(w.word, w.nbits)
+	}
+	w.word, w.nbits = 0, 0
+}
+
+// pushed returns the number of bits pushed, including those not flushed.
+func (w *bitWriter) pushed() uint64 {
+	return w.out.num + w.nbits
+}
+
+// pushZeros pushes n zeros.
+func (w *bitWriter) pushZeros(n uint64) {
+	for n > 0 {
+		k := min(n, kSmallBlockSize-w.nbits)
+		w.nbits += k
+		n -= k
+		if w.nbits == kSmallBlockSize {
+			w.flush()
+		}
+	}
+}
@@ -1,5 +1,5 @@
 // Package rsdic provides a rank/select dictionary
-// supporting many basic operations in constant time
+// supporting many basic operations in (nearly) constant time
 // using very small working space (smaller than original).
 package rsdic
 
@@ -7,7 +7,8 @@ package rsdic
 //
 // Conceptually RSDic represents a bit vector B[0...num), B[i] = 0 or 1,
 // and these bits are set by PushBack (Thus RSDic can handle growing bits).
-// All operations (Bit, Rank, Select) are supported in O(1) time.
+// All operations (Bit, Rank, Select) are supported in O(log r) time for r runs
+// of uniform large blocks, i.e. in O(1) time for bit vectors without runs.
 // (also called as fully indexable dictionary in CS literatures (FID)).
 //
 // In RSDic, a bit vector is stored in compressed (Note, we don't need to decode all at operations)
@@ -16,6 +17,11 @@ package rsdic
 // and 54 zeros, the block is compressed in 38 bits (See enumCode.go for detail)
 // This achieves not only its information theoretic bound, but also achieves more compression
 // if same bits appeared togather (e.g. 000...000111...111000...000)
+// Large blocks of the same bits are further merged into runs (See lblock.go for detail)
+//
+// Queries may be called by any number of goroutines concurrently, but not
+// during modifications; use Concurrent to query while bits are pushed back
+// (See concurrent.go for detail)
 //
 // See performance in readme.md
 //
@@ -24,6 +30,7 @@ package rsdic
 
 import (
 	"encoding/binary"
+	"fmt"
 	"os"
 
 	"github.com/ugorji/go/codec"
@@ -63,6 +70,23 @@ type RSDic struct {
 	bits              *BufferedBits
 	rankBlockLength   uint64
 	rankSmBlockLength uint64
+	denseBlockLength  uint64
+	runBlockLength    uint64
+	selectOneLength   uint64 // the number of entries of select_one_ind.bin
+	selectZeroLength  uint64 // the number of entries of select_zero_ind.bin
+	openRun           runBlock
+	hasOpenRun        bool
+	pendRank          uint64
+	pendPointer       uint64
+	pendSmall         []uint8
+	cache             *blockCache
+	readOnly          bool     // whether this is a snapshot
+	readLocked        bool     // whether the directory is locked for the reader (See lock.go)
+	writeLocked       bool     // whether the directory is locked for the writer
+	legacy            bool     // whether the files are of format version 0 (See lblock.go)
+	created           bool     // whether New created the directory
+	sets              []uint64 // positions set to one by Set over zeros, sorted (See set.go)
+	clears            []uint64 // positions cleared to zero by Set over ones, sorted
 }
 
 // Num returns the number of bits
@@ -72,78 +96,132 @@ func (rs RSDic) Num() uint64 {
 
 // OneNum returns the number of ones in bits
 func (rs RSDic) OneNum() uint64 {
-	return rs.oneNum
+	return rs.oneNum + uint64(len(rs.sets)) - uint64(len(rs.clears))
 }
 
 // ZeroNum returns the number of zeros in bits
 func (rs RSDic) ZeroNum() uint64 {
-	return rs.zeroNum
+	return rs.num - rs.OneNum()
 }
 
 // PushBack appends the bit to the end of B
 func (rs *RSDic) PushBack(bit bool) {
+	if rs.readOnly {
+		panic(errReadOnly)
+	}
 	if (rs.num % kSmallBlockSize) == 0 {
 		rs.writeBlock()
 	}
 	if bit {
 		rs.lastBlock |= (1 << (rs.num % kSmallBlockSize))
-		if (rs.oneNum % kSelectBlockSize) == 0 {
-			appendUint64(rs.writer.selectOneWriter, rs.num/kLargeBlockSize)
-		}
 		rs.oneNum++
 		rs.lastOneNum++
 	} else {
-		if (rs.zeroNum % kSelectBlockSize) == 0 {
-			appendUint64(rs.writer.selectZeroWriter, rs.num/kLargeBlockSize)
-		}
 		rs.zeroNum++
 		rs.lastZeroNum++
 	}
 	rs.num++
 }
 
-func (rs *RSDic) writeBlock() {
-	if rs.num > 0 {
-		rankSB := uint8(rs.lastOneNum)
-		appendUint8(rs.writer.rankSmallWriter, rankSB)
-		rs.rankSmBlockLength++
-		codeLen := kEnumCodeLength[rankSB]
-		code := enumEncode(rs.lastBlock, rankSB)
-		newSize := floor(rs.codeLen+uint64(codeLen), kSmallBlockSize)
-		if newSize > rs.bits.writeBitsSize {
-			if rs.bits.isSet[0] {
-				toWrite := make([]byte, 8)
-				binary.LittleEndian.PutUint64(toWrite, rs.bits.writeBits[0])
-				rs.writer.bitsWriter.Write(toWrite)
-				rs.bits.numWritten++
-				// fmt.Println("toWrite", toWrite)
-			}
-			// writer.Write(toWrite)
-
-			rs.bits.writeBits[0] = rs.bits.writeBits[1]
-			rs.bits.writeBits[1] = 0
-			rs.bits.writeBitsSize++
-
-			rs.bits.isSet[0] = rs.bits.isSet[1]
-			rs.bits.isSet[1] = false
+// pushWord appends the lowest nbits bits of word to the end of B,
+// filling the last small block and starting a new one as needed.
+func (rs *RSDic) pushWord(word uint64, nbits uint64) {
+	for nbits > 0 {
+		if (rs.num % kSmallBlockSize) == 0 {
+			rs.writeBlock()
 		}
+		n := min(kSmallBlockSize-rs.num%kSmallBlockSize, nbits)
+		rs.pushLastBits(word&((1<<n)-1), n)
+		word >>= n
+		nbits -= n
+	}
+}
+
+// pushLastBits appends n bits to the last small block, which must have room for them.
+func (rs *RSDic) pushLastBits(bits uint64, n uint64) {
+	oneNum := uint64(popCount(bits))
+	zeroNum := n - oneNum
+	rs.lastBlock |= bits << (rs.num % kSmallBlockSize)
+	rs.lastOneNum += oneNum
+	rs.lastZeroNum += zeroNum
+	rs.oneNum += oneNum
+	rs.zeroNum += zeroNum
+	rs.num += n
+}
 
-		setSliceBuffer(rs.bits, rs.codeLen, codeLen, code)
-		// fmt.Println(rs.bits, rs.writeBits)
+// pushCode appends a full small block given by its code, without decoding it.
+// B must end at a small block boundary, and the last small block must have been
+// written by writeBlock (or pushCode). Thus, the last small block is left empty,
+// and the caller must append at least one bit by pushLastBits before anything else.
+func (rs *RSDic) pushCode(rankSB uint8, code uint64) {
+	oneNum := uint64(rankSB)
+	zeroNum := kSmallBlockSize - oneNum
+	rs.writeCode(rankSB, code)
+	rs.oneNum += oneNum
+	rs.zeroNum += zeroNum
+	rs.num += kSmallBlockSize
+	if (rs.num % kLargeBlockSize) == 0 {
+		rs.startLargeBlock()
+	}
+}
 
+func (rs *RSDic) writeBlock() {
+	if rs.num > 0 {
+		rankSB := uint8(rs.lastOneNum)
+		rs.writeCode(rankSB, enumEncode(rs.lastBlock, rankSB))
 		rs.lastBlock = 0
 		rs.lastZeroNum = 0
 		rs.lastOneNum = 0
-		rs.codeLen += uint64(codeLen)
 	}
 	if (rs.num % kLargeBlockSize) == 0 {
-		// rs.rankBlocks = append(rs.rankBlocks, rs.oneNum)
-		// rs.pointerBlocks = append(rs.pointerBlocks, rs.codeLen)
+		rs.startLargeBlock()
+	}
+}
+
+// writeCode appends the code of a completed small block.
+func (rs *RSDic) writeCode(rankSB uint8, code uint64) {
+	rs.pendSmall = append(rs.pendSmall, rankSB)
+	rs.rankSmBlockLength++
+	rs.appendBits(code, kEnumCodeLength[rankSB])
+	if len(rs.pendSmall) == kSmallBlockPerLargeBlock {
+		rs.writeLargeBlock()
+	}
+}
+
+// appendBits appends the lowest codeLen bits of code to the codes in bits.
+func (rs *RSDic) appendBits(code uint64, codeLen uint8) {
+	newSize := floor(rs.codeLen+uint64(codeLen), kSmallBlockSize)
+	if newSize > rs.bits.writeBitsSize {
+		if rs.bits.isSet[0] {
+			toWrite := make([]byte, 8)
+			binary.LittleEndian.PutUint64(toWrite, rs.bits.writeBits[0])
+			rs.writer.bitsWriter.Write(toWrite)
+			rs.bits.numWritten++
+			// fmt.Println("toWrite", toWrite)
+		}
+		// writer.Write(toWrite)
+
+		rs.bits.writeBits[0] = rs.bits.writeBits[1]
+		rs.bits.writeBits[1] = 0
+		rs.bits.writeBitsSize++
 
-		appendUint64(rs.writer.rankWriter, rs.oneNum)
-		appendUint64(rs.writer.pointerWriter, rs.codeLen)
-		rs.rankBlockLength++
+		rs.bits.isSet[0] = rs.bits.isSet[1]
+		rs.bits.isSet[1] = false
 	}
+
+	setSliceBuffer(rs.bits, rs.codeLen, codeLen, code)
+	// fmt.Println(rs.bits, rs.writeBits)
+
+	rs.codeLen += uint64(codeLen)
+}
+
+// startLargeBlock starts the large block at the end of B.
+func (rs *RSDic) startLargeBlock() {
+	// the new large block is written by writeLargeBlock when completed
+	rs.pendRank = rs.oneNum
+	rs.pendPointer = rs.codeLen
+	rs.pendSmall = rs.pendSmall[:0]
+	rs.rankBlockLength++
 }
 
 func (rs RSDic) lastBlockInd() uint64 {
@@ -159,23 +237,35 @@ func (rs RSDic) isLastBlock(pos uint64) bool {
 
 // Bit returns the (pos+1)-th bit in bits, i.e. bits[pos]
 func (rs RSDic) Bit(pos uint64) bool {
+	if rs.updated() {
+		return rs.updatedBit(pos)
+	}
 	if rs.isLastBlock(pos) {
 		return getBit(rs.lastBlock, uint8(pos%kSmallBlockSize))
 	}
-	lblock := pos / kLargeBlockSize
-	// pointer := rs.pointerBlocks[lblock]
-	pointer := readUint64(rs.reader.pointerReader, lblock)
+	lb := rs.lblockAt(pos / kLargeBlockSize)
+	if lb.run {
+		return lb.bit
+	}
+	pointer := lb.pointer
 	sblock := pos / kSmallBlockSize
-	for i := lblock * kSmallBlockPerLargeBlock; i < sblock; i++ {
-		pointer += uint64(kEnumCodeLength[readUint8(rs.reader.rankSmallReader, i)])
+	sIdx := sblock % kSmallBlockPerLargeBlock
+	for i := uint64(0); i < sIdx; i++ {
+		pointer += uint64(kEnumCodeLength[rs.smallRank(lb, i)])
+	}
+	rankSB := rs.smallRank(lb, sIdx)
+	if rs.cache != nil {
+		return getBit(rs.cachedBlock(sblock, rankSB, pointer), uint8(pos%kSmallBlockSize))
 	}
-	rankSB := readUint8(rs.reader.rankSmallReader, sblock)
 	code := getSliceBuffer(rs.reader.bitsReader, rs.bits, pointer, kEnumCodeLength[rankSB])
 	return enumBit(code, rankSB, uint8(pos%kSmallBlockSize))
 }
 
 // Rank returns the number of bit's in B[0...pos)
 func (rs RSDic) Rank(pos uint64, bit bool) uint64 {
+	if rs.updated() {
+		return rs.updatedRank(pos, bit)
+	}
 	if pos >= rs.num {
 		return bitNum(rs.oneNum, rs.num, bit)
 	}
@@ -183,20 +273,32 @@ func (rs RSDic) Rank(pos uint64, bit bool) uint64 {
 		afterRank := popCount(rs.lastBlock >> (pos % kSmallBlockSize))
 		return bitNum(rs.oneNum-uint64(afterRank), pos, bit)
 	}
-	lblock := pos / kLargeBlockSize
-	// pointer := rs.pointerBlocks[lblock]
-	pointer := readUint64(rs.reader.pointerReader, lblock)
+	lb := rs.lblockAt(pos / kLargeBlockSize)
+	if lb.run {
+		rank := lb.rank
+		if lb.bit {
+			rank += pos % kLargeBlockSize
+		}
+		return bitNum(rank, pos, bit)
+	}
+	pointer := lb.pointer
 	sblock := pos / kSmallBlockSize
-	rank := readUint64(rs.reader.rankReader, lblock)
-	for i := lblock * kSmallBlockPerLargeBlock; i < sblock; i++ {
-		rankSB := readUint8(rs.reader.rankSmallReader, i)
+	sIdx := sblock % kSmallBlockPerLargeBlock
+	rank := lb.rank
+	for i := uint64(0); i < sIdx; i++ {
+		rankSB := rs.smallRank(lb, i)
 		pointer += uint64(kEnumCodeLength[rankSB])
 		rank += uint64(rankSB)
 	}
 	if pos%kSmallBlockSize == 0 {
 		return bitNum(rank, pos, bit)
 	}
-	rankSB := readUint8(rs.reader.rankSmallReader, sblock)
+	rankSB := rs.smallRank(lb, sIdx)
+	if rs.cache != nil {
+		word := rs.cachedBlock(sblock, rankSB, pointer)
+		rank += uint64(popCount(word & ((1 << (pos % kSmallBlockSize)) - 1)))
+		return bitNum(rank, pos, bit)
+	}
 	code := getSliceBuffer(rs.reader.bitsReader, rs.bits, pointer, kEnumCodeLength[rankSB])
 	rank += uint64(enumRank(code, rankSB, uint8(pos%kSmallBlockSize)))
 	return bitNum(rank, pos, bit)
@@ -213,39 +315,97 @@ func (rs RSDic) Select(rank uint64, bit bool) uint64 {
 	}
 }
 
+// selectLBlock returns the large block containing the (rank+1)-th occurence of bit,
+// scanning large blocks from the one given by selectStart.
+func (rs *RSDic) selectLBlock(rank uint64, bit bool) lblock {
+	lb := rs.selectStart(rank, bit)
+	for !lb.run && lb.end < rs.rankBlockLength {
+		next := rs.nextLBlock(lb)
+		if rank < bitNum(next.rank, next.index*kLargeBlockSize, bit) {
+			break
+		}
+		lb = next
+	}
+	return lb
+}
+
+// selectStart returns the large block of the (rank+1)-th occurence of bit if it is
+// in a run, and otherwise a large block at or before it among the dense large
+// blocks after the last run before it: that of the select sample of rank if
+// the sample is after the run, or the one just after the run.
+func (rs *RSDic) selectStart(rank uint64, bit bool) lblock {
+	sample := rank / kSelectBlockSize
+	if rs.runNum() > 0 {
+		// find the number of runs whose occurrences of bit start at or before rank
+		lo, hi := uint64(0), rs.runNum()
+		for lo < hi {
+			mid := (lo + hi) / 2
+			if start, _ := rs.runAt(mid).bitRange(bit); start <= rank {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		if lo > 0 {
+			run := rs.runAt(lo - 1)
+			start, end := run.bitRange(bit)
+			if rank < end {
+				return rs.runLBlock(run.start+(rank-start)/kLargeBlockSize, lo-1, run)
+			}
+			if sample*kSelectBlockSize < end {
+				return rs.lblockAt(run.end)
+			}
+			sample -= run.samplesThrough(bit)
+		}
+	}
+	if bit && sample < rs.selectOneLength {
+		return rs.lblockAt(readUint64(rs.reader.selectOneReader, sample))
+	} else if !bit && sample < rs.selectZeroLength {
+		return rs.lblockAt(readUint64(rs.reader.selectZeroReader, sample))
+	}
+	// the sample is in the last large block, whose samples are written when it is completed
+	return rs.lblockAt(rs.rankBlockLength - 1)
+}
+
 func (rs RSDic) Select1(rank uint64) uint64 {
+	if rs.updated() {
+		return rs.updatedSelect(rank, true)
+	}
 	if rank >= rs.oneNum {
 		return rs.num
 	} else if rank >= rs.oneNum-rs.lastOneNum {
 		lastBlockRank := uint8(rank - (rs.oneNum - rs.lastOneNum))
 		return rs.lastBlockInd() + uint64(selectRaw(rs.lastBlock, lastBlockRank+1))
 	}
-	selectInd := rank / kSelectBlockSize
-	lblock := readUint64(rs.reader.selectOneReader, selectInd)
-	for ; lblock < rs.rankBlockLength; lblock++ {
-		if rank < readUint64(rs.reader.rankReader, lblock) {
-			break
-		}
+	lb := rs.selectLBlock(rank, true)
+	if lb.run {
+		return lb.index*kLargeBlockSize + rank - lb.rank
 	}
-	lblock--
-	sblock := lblock * kSmallBlockPerLargeBlock
-	// pointer := rs.pointerBlocks[lblock]
-	pointer := readUint64(rs.reader.pointerReader, lblock)
-	remain := rank - readUint64(rs.reader.rankReader, lblock) + 1
-	for ; sblock < rs.rankSmBlockLength; sblock++ {
-		rankSB := readUint8(rs.reader.rankSmallReader, sblock)
+	sIdx := uint64(0)
+	pointer := lb.pointer
+	remain := rank - lb.rank + 1
+	for ; sIdx < kSmallBlockPerLargeBlock; sIdx++ {
+		rankSB := rs.smallRank(lb, sIdx)
 		if remain <= uint64(rankSB) {
 			break
 		}
 		remain -= uint64(rankSB)
 		pointer += uint64(kEnumCodeLength[rankSB])
 	}
-	rankSB := readUint8(rs.reader.rankSmallReader, sblock)
+	sblock := lb.index*kSmallBlockPerLargeBlock + sIdx
+	rankSB := rs.smallRank(lb, sIdx)
+	if rs.cache != nil {
+		word := rs.cachedBlock(sblock, rankSB, pointer)
+		return sblock*kSmallBlockSize + uint64(selectRaw(word, uint8(remain)))
+	}
 	code := getSliceBuffer(rs.reader.bitsReader, rs.bits, pointer, kEnumCodeLength[rankSB])
 	return sblock*kSmallBlockSize + uint64(enumSelect1(code, rankSB, uint8(remain)))
 }
 
 func (rs RSDic) Select0(rank uint64) uint64 {
+	if rs.updated() {
+		return rs.updatedSelect(rank, false)
+	}
 	if rank >= rs.zeroNum {
 		return rs.num
 	}
@@ -253,27 +413,28 @@ func (rs RSDic) Select0(rank uint64) uint64 {
 		lastBlockRank := uint8(rank - (rs.zeroNum - rs.lastZeroNum))
 		return rs.lastBlockInd() + uint64(selectRaw(^rs.lastBlock, lastBlockRank+1))
 	}
-	selectInd := rank / kSelectBlockSize
-	lblock := readUint64(rs.reader.selectZeroReader, selectInd)
-	for ; lblock < rs.rankBlockLength; lblock++ {
-		if rank < (lblock*kLargeBlockSize - readUint64(rs.reader.rankReader, lblock)) {
-			break
-		}
-	}
-	lblock--
-	sblock := lblock * kSmallBlockPerLargeBlock
-	// pointer := rs.pointerBlocks[lblock]
-	pointer := readUint64(rs.reader.pointerReader, lblock)
-	remain := rank - lblock*kLargeBlockSize + readUint64(rs.reader.rankReader, lblock) + 1
-	for ; sblock < rs.rankSmBlockLength; sblock++ {
-		rankSB := kSmallBlockSize - readUint8(rs.reader.rankSmallReader, sblock)
-		if remain <= uint64(rankSB) {
+	lb := rs.selectLBlock(rank, false)
+	zeroRank := lb.index*kLargeBlockSize - lb.rank
+	if lb.run {
+		return lb.index*kLargeBlockSize + rank - zeroRank
+	}
+	sIdx := uint64(0)
+	pointer := lb.pointer
+	remain := rank - zeroRank + 1
+	for ; sIdx < kSmallBlockPerLargeBlock; sIdx++ {
+		rankSB := rs.smallRank(lb, sIdx)
+		if remain <= uint64(kSmallBlockSize-rankSB) {
 			break
 		}
-		remain -= uint64(rankSB)
+		remain -= uint64(kSmallBlockSize - rankSB)
 		pointer += uint64(kEnumCodeLength[rankSB])
 	}
-	rankSB := readUint8(rs.reader.rankSmallReader, sblock)
+	sblock := lb.index*kSmallBlockPerLargeBlock + sIdx
+	rankSB := rs.smallRank(lb, sIdx)
+	if rs.cache != nil {
+		word := rs.cachedBlock(sblock, rankSB, pointer)
+		return sblock*kSmallBlockSize + uint64(selectRaw(^word, uint8(remain)))
+	}
 	code := getSliceBuffer(rs.reader.bitsReader, rs.bits, pointer, kEnumCodeLength[rankSB])
 	return sblock*kSmallBlockSize + uint64(enumSelect0(code, rankSB, uint8(remain)))
 }
@@ -282,39 +443,46 @@ func (rs RSDic) Select0(rank uint64) uint64 {
 // Although this is equivalent to b := Bit(pos), r := Rank(pos, b),
 // BitAndRank is faster.
 func (rs RSDic) BitAndRank(pos uint64) (bool, uint64) {
+	if rs.updated() {
+		bit := rs.updatedBit(pos)
+		return bit, rs.updatedRank(pos, bit)
+	}
 	if rs.isLastBlock(pos) {
 		offset := uint8(pos % kSmallBlockSize)
 		bit := getBit(rs.lastBlock, offset)
 		afterRank := uint64(popCount(rs.lastBlock >> offset))
 		return bit, bitNum(rs.oneNum-afterRank, pos, bit)
 	}
-	lblock := pos / kLargeBlockSize
-	// pointer := rs.pointerBlocks[lblock]
-	pointer := readUint64(rs.reader.pointerReader, lblock)
+	lb := rs.lblockAt(pos / kLargeBlockSize)
+	if lb.run {
+		if lb.bit {
+			return true, lb.rank + pos%kLargeBlockSize
+		}
+		return false, pos - lb.rank
+	}
+	pointer := lb.pointer
 	sblock := pos / kSmallBlockSize
-	rank := readUint64(rs.reader.rankReader, lblock)
-	for i := lblock * kSmallBlockPerLargeBlock; i < sblock; i++ {
-		rankSB := readUint8(rs.reader.rankSmallReader, i)
+	sIdx := sblock % kSmallBlockPerLargeBlock
+	rank := lb.rank
+	for i := uint64(0); i < sIdx; i++ {
+		rankSB := rs.smallRank(lb, i)
 		pointer += uint64(kEnumCodeLength[rankSB])
 		rank += uint64(rankSB)
 	}
-	rankSB := readUint8(rs.reader.rankSmallReader, sblock)
+	rankSB := rs.smallRank(lb, sIdx)
+	offset := uint8(pos % kSmallBlockSize)
+	if rs.cache != nil {
+		word := rs.cachedBlock(sblock, rankSB, pointer)
+		rank += uint64(popCount(word & ((1 << offset) - 1)))
+		bit := getBit(word, offset)
+		return bit, bitNum(rank, pos, bit)
+	}
 	code := getSliceBuffer(rs.reader.bitsReader, rs.bits, pointer, kEnumCodeLength[rankSB])
-	rank += uint64(enumRank(code, rankSB, uint8(pos%kSmallBlockSize)))
-	bit := enumBit(code, rankSB, uint8(pos%kSmallBlockSize))
+	rank += uint64(enumRank(code, rankSB, offset))
+	bit := enumBit(code, rankSB, offset)
 	return bit, bitNum(rank, pos, bit)
 }
 
-// AllocSize returns the allocated size in bytes.
-// func (rsd RSDic) AllocSize() int {
-// 	return rsd.bits.Length()*8 +
-// 		len(rsd.pointerBlocks)*8 +
-// 		len(rsd.rankBlocks)*8 +
-// 		len(rsd.selectOneInds)*8 +
-// 		len(rsd.selectZeroInds)*8 +
-// 		len(rsd.rankSmallBlocks)*1
-// }
-
 // MarshalBinary encodes the RSDic into a binary form and returns the result.
 func (rsd RSDic) MarshalBinary() (out []byte, err error) {
 	var bh codec.MsgpackHandle
@@ -376,6 +544,78 @@ func (rsd RSDic) MarshalBinary() (out []byte, err error) {
 	if err != nil {
 		return
 	}
+	err = enc.Encode(uint8(kFormatVersion))
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.denseBlockLength)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.runBlockLength)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.selectOneLength)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.selectZeroLength)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.hasOpenRun)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.openRun.start)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.openRun.end)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.openRun.bit)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.openRun.rank)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.openRun.phys)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.openRun.oneSamples)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.openRun.zeroSamples)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.pendRank)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.pendPointer)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.pendSmall)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.sets)
+	if err != nil {
+		return
+	}
+	err = enc.Encode(rsd.clears)
+	if err != nil {
+		return
+	}
 	return
 }
 
@@ -441,6 +681,95 @@ func (rsd *RSDic) UnmarshalBinary(in []byte) (err error) {
 	if err != nil {
 		return
 	}
+	if dec.NumBytesRead() == len(in) {
+		// the metadata of format version 0 ends here
+		rsd.setLegacy()
+		if rsd.cache != nil {
+			rsd.cache.purge()
+		}
+		return
+	}
+	var version uint8
+	err = dec.Decode(&version)
+	if err != nil {
+		return
+	}
+	err = checkFormatVersion(version)
+	if err != nil {
+		return
+	}
+	rsd.legacy = false
+	err = dec.Decode(&rsd.denseBlockLength)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.runBlockLength)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.selectOneLength)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.selectZeroLength)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.hasOpenRun)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.openRun.start)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.openRun.end)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.openRun.bit)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.openRun.rank)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.openRun.phys)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.openRun.oneSamples)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.openRun.zeroSamples)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.pendRank)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.pendPointer)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.pendSmall)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.sets)
+	if err != nil {
+		return
+	}
+	err = dec.Decode(&rsd.clears)
+	if err != nil {
+		return
+	}
+	if rsd.cache != nil {
+		rsd.cache.purge()
+	}
 	return
 }
 
@@ -460,6 +789,24 @@ func (rsd *RSDic) CodecEncodeSelf(enc *codec.Encoder) {
 	enc.MustEncode(rsd.bits.numWritten)
 	enc.MustEncode(rsd.rankBlockLength)
 	enc.MustEncode(rsd.rankSmBlockLength)
+	enc.MustEncode(uint8(kFormatVersion))
+	enc.MustEncode(rsd.denseBlockLength)
+	enc.MustEncode(rsd.runBlockLength)
+	enc.MustEncode(rsd.selectOneLength)
+	enc.MustEncode(rsd.selectZeroLength)
+	enc.MustEncode(rsd.hasOpenRun)
+	enc.MustEncode(rsd.openRun.start)
+	enc.MustEncode(rsd.openRun.end)
+	enc.MustEncode(rsd.openRun.bit)
+	enc.MustEncode(rsd.openRun.rank)
+	enc.MustEncode(rsd.openRun.phys)
+	enc.MustEncode(rsd.openRun.oneSamples)
+	enc.MustEncode(rsd.openRun.zeroSamples)
+	enc.MustEncode(rsd.pendRank)
+	enc.MustEncode(rsd.pendPointer)
+	enc.MustEncode(rsd.pendSmall)
+	enc.MustEncode(rsd.sets)
+	enc.MustEncode(rsd.clears)
 }
 
 // Selfer interface for codec library
@@ -480,6 +827,40 @@ func (rsd *RSDic) CodecDecodeSelf(dec *codec.Decoder) {
 	dec.MustDecode(&rsd.bits.numWritten)
 	dec.MustDecode(&rsd.rankBlockLength)
 	dec.MustDecode(&rsd.rankSmBlockLength)
+	var version uint8
+	dec.MustDecode(&version)
+	if err := checkFormatVersion(version); err != nil {
+		panic(err) // which codec returns as the error of Decode
+	}
+	rsd.legacy = false
+	dec.MustDecode(&rsd.denseBlockLength)
+	dec.MustDecode(&rsd.runBlockLength)
+	dec.MustDecode(&rsd.selectOneLength)
+	dec.MustDecode(&rsd.selectZeroLength)
+	dec.MustDecode(&rsd.hasOpenRun)
+	dec.MustDecode(&rsd.openRun.start)
+	dec.MustDecode(&rsd.openRun.end)
+	dec.MustDecode(&rsd.openRun.bit)
+	dec.MustDecode(&rsd.openRun.rank)
+	dec.MustDecode(&rsd.openRun.phys)
+	dec.MustDecode(&rsd.openRun.oneSamples)
+	dec.MustDecode(&rsd.openRun.zeroSamples)
+	dec.MustDecode(&rsd.pendRank)
+	dec.MustDecode(&rsd.pendPointer)
+	dec.MustDecode(&rsd.pendSmall)
+	dec.MustDecode(&rsd.sets)
+	dec.MustDecode(&rsd.clears)
+	if rsd.cache != nil {
+		rsd.cache.purge()
+	}
+}
+
+// checkFormatVersion checks that the metadata is of a version this package can read.
+func checkFormatVersion(version uint8) error {
+	if version != kFormatVersion {
+		return fmt.Errorf("rsdic: format version %d is not supported (expected %d)", version, kFormatVersion)
+	}
+	return nil
 }
 
 func NewBits() *BufferedBits {
@@ -502,6 +883,7 @@ func New(path string) (*RSDic, error) {
 
 	return &RSDic{
 		path:              path,
+		created:           err == nil,
 		num:               0,
 		oneNum:            0,
 		zeroNum:           0,
@@ -512,19 +894,46 @@ func New(path string) (*RSDic, error) {
 		bits:              NewBits(),
 		rankBlockLength:   0,
 		rankSmBlockLength: 0,
+		denseBlockLength:  0,
+		runBlockLength:    0,
+		selectOneLength:   0,
+		selectZeroLength:  0,
+		pendSmall:         make([]uint8, 0, kSmallBlockPerLargeBlock),
 	}, nil
 }
 
 func (rsd *RSDic) LoadReader() error {
+	if !rsd.readLocked {
+		locked, err := lockDir(rsd.path, false)
+		if err != nil {
+			return err
+		}
+		rsd.readLocked = locked
+	}
 	reader, err := InitReaders(rsd.path)
 	if err != nil {
 		return err
 	}
 	rsd.reader = reader
+	if rsd.legacy {
+		rsd.loadLegacyLargeBlock()
+	}
 	return nil
 }
 
+// LoadWriter creates the files of the directory for PushBack, truncating
+// them if they exist. It fails with ErrLocked if the directory is used by
+// another process or has another writer in this process (See lock.go).
 func (rsd *RSDic) LoadWriter() error {
+	if rsd.readOnly {
+		return errReadOnly
+	}
+	if !rsd.writeLocked {
+		if _, err := lockDir(rsd.path, true); err != nil {
+			return err
+		}
+		rsd.writeLocked = true
+	}
 	writer, err := InitWriters(rsd.path)
 	if err != nil {
 		return err
@@ -533,9 +942,34 @@ func (rsd *RSDic) LoadWriter() error {
 	return nil
 }
 
+// CloseReader releases the mapped files and the lock taken by LoadReader.
+func (rsd *RSDic) CloseReader() error {
+	var err error
+	if rsd.reader != nil {
+		err = rsd.reader.Close()
+		rsd.reader = nil
+	}
+	if rsd.readLocked {
+		rsd.readLocked = false
+		if unlockErr := unlockDir(rsd.path, false); err == nil {
+			err = unlockErr
+		}
+	}
+	return err
+}
+
+// CloseWriter closes the files and releases the lock taken by LoadWriter.
 func (rsd *RSDic) CloseWriter() error {
+	var err error
 	if rsd.writer != nil {
-		return rsd.writer.Close()
+		err = rsd.writer.Close()
+		rsd.writer = nil
 	}
-	return nil
+	if rsd.writeLocked {
+		rsd.writeLocked = false
+		if unlockErr := unlockDir(rsd.path, true); err == nil {
+			err = unlockErr
+		}
+	}
+	return err
 }
@@ -1,13 +1,22 @@
 package rsdic
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/ugorji/go/codec"
 )
 
 func TestEmptyRSDic(t *testing.T) {
@@ -162,10 +171,11 @@ func runTestRSDic(name string, t *testing.T, rsd *RSDic, raw *rawBitVector) {
 
 		out, err := rsd.MarshalBinary()
 		So(err, ShouldBeNil)
-		newrsd, err := New("test")
+		newrsd, err := New(rsd.path)
 		So(err, ShouldBeNil)
 
 		newrsd.LoadReader()
+		defer newrsd.CloseReader()
 
 		err = newrsd.UnmarshalBinary(out)
 		So(err, ShouldBeNil)
@@ -185,6 +195,7 @@ func runTestRSDic(name string, t *testing.T, rsd *RSDic, raw *rawBitVector) {
 
 func TestRandomSmallRSDic(t *testing.T) {
 	raw, rsd := initBitVector(500, 0.8)
+	defer rsd.CloseReader()
 	// fmt.Println(rsd.rankBlocks)
 	// fmt.Println(rsd.pointerBlocks)
 	// fmt.Println(rsd.rankBlockLength)
@@ -196,24 +207,1078 @@ func TestRandomSmallRSDic(t *testing.T) {
 
 func TestRandomLargeRSDic(t *testing.T) {
 	raw, rsd := initBitVector(100000, 0.5)
+	defer rsd.CloseReader()
 	runTestRSDic("When a large bit vector is assigned", t, rsd, raw)
 }
 
 func TestRandomVeryLargeRSDic(t *testing.T) {
 	raw, rsd := initBitVector(4000000, 0.8)
+	defer rsd.CloseReader()
 	runTestRSDic("When a large bit vector is assigned", t, rsd, raw)
 }
 
 func TestRandomLargeSparseRSDic(t *testing.T) {
 	raw, rsd := initBitVector(100000, 0.01)
+	defer rsd.CloseReader()
 	runTestRSDic("When a large sparse bit vector is assigned", t, rsd, raw)
 }
 
 func TestRandomAllZeroRSDic(t *testing.T) {
 	raw, rsd := initBitVector(100, 0)
+	defer rsd.CloseReader()
 	runTestRSDic("When a large zero bit vector is assigned", t, rsd, raw)
 }
 
+func rawWords(orig []uint8, start uint64, nbits uint64) []uint64 {
+	words := make([]uint64, floor(nbits, kSmallBlockSize))
+	for i := uint64(0); i < nbits; i++ {
+		if orig[start+i] == 1 {
+			words[i/kSmallBlockSize] |= 1 << (i % kSmallBlockSize)
+		}
+	}
+	return words
+}
+
+func TestGetWords(t *testing.T) {
+	raw, rsd := initBitVector(10000, 0.3)
+	defer rsd.CloseReader()
+	Convey("When words are extracted from a bit vector", t, func() {
+		for i := 0; i < testNum; i++ {
+			start := uint64(rand.Int31n(int32(raw.num)))
+			nbits := uint64(rand.Int31n(int32(raw.num - start + 1)))
+			if i == 0 {
+				start, nbits = 0, raw.num
+			}
+			So(rsd.GetWords(start, nbits, []uint64{}), ShouldResemble, rawWords(raw.orig, start, nbits))
+		}
+		So(rsd.GetWords(raw.num, 0, nil), ShouldBeEmpty)
+
+		var buf bytes.Buffer
+		So(rsd.DecodeAll(&buf), ShouldBeNil)
+		words := rawWords(raw.orig, 0, raw.num)
+		So(buf.Len(), ShouldEqual, len(words)*8)
+		for i, word := range words {
+			So(binary.LittleEndian.Uint64(buf.Bytes()[i*8:]), ShouldEqual, word)
+		}
+	})
+}
+
+func TestBlockCache(t *testing.T) {
+	raw, rsd := initBitVector(100000, 0.3)
+	defer rsd.CloseReader()
+	rsd.SetBlockCache(32)
+	inds := make([]uint64, 50)
+	for i := range inds {
+		inds[i] = uint64(rand.Int31n(int32(raw.num)))
+	}
+	Convey("When the decoded block cache is enabled", t, func() {
+		for round := 0; round < 2; round++ {
+			for _, ind := range inds {
+				So(rsd.Bit(ind), ShouldEqual, raw.orig[ind] == 1)
+				So(rsd.Rank(ind, true), ShouldEqual, raw.ranks[ind])
+				bit, rank := rsd.BitAndRank(ind)
+				So(bit, ShouldEqual, raw.orig[ind] == 1)
+				So(rsd.Select(rank, bit), ShouldEqual, ind)
+			}
+		}
+		stats := rsd.BlockCacheStats()
+		So(stats.Hits, ShouldBeGreaterThan, 0)
+		So(stats.Misses, ShouldBeGreaterThan, 0)
+		So(stats.Size, ShouldBeLessThanOrEqualTo, 32)
+
+		Convey("Concurrent queries should return the same results", func() {
+			var wg sync.WaitGroup
+			errs := make([]int, 8)
+			for g := range errs {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for _, ind := range inds {
+						if rsd.Bit(ind) != (raw.orig[ind] == 1) || rsd.Rank(ind, true) != raw.ranks[ind] {
+							errs[g]++
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+			So(errs, ShouldResemble, make([]int, 8))
+		})
+	})
+}
+
+func initBitVectorFromBits(orig []uint8) (*rawBitVector, *RSDic) {
+	return initBitVectorAt("test", orig)
+}
+
+func initBitVectorAt(path string, orig []uint8) (*rawBitVector, *RSDic) {
+	if err := os.MkdirAll(path, 0777); err != nil {
+		panic(err)
+	}
+	rsd, err := New(path)
+	if err != nil {
+		panic(err)
+	}
+
+	rsd.LoadWriter()
+	defer rsd.CloseWriter()
+
+	for i := range orig {
+		rsd.PushBack(orig[i] == 1)
+	}
+
+	rsd.LoadReader()
+
+	return newRawBitVector(orig), rsd
+}
+
+func newRawBitVector(orig []uint8) *rawBitVector {
+	num := uint64(len(orig))
+	ranks := make([]uint64, num)
+	oneNum := uint64(0)
+	for i := uint64(0); i < num; i++ {
+		ranks[i] = oneNum
+		if orig[i] == 1 {
+			oneNum++
+		}
+	}
+	return &rawBitVector{
+		orig,
+		ranks,
+		num,
+		oneNum,
+	}
+}
+
+// runBits returns bits consisting of uniform runs spanning several large blocks
+// and random regions between them.
+func runBits(segments int) []uint8 {
+	orig := []uint8{}
+	for i := 0; i < segments; i++ {
+		runLen := rand.Intn(8*kLargeBlockSize) + kLargeBlockSize
+		bit := uint8(i % 2)
+		for j := 0; j < runLen; j++ {
+			orig = append(orig, bit)
+		}
+		randLen := rand.Intn(2 * kLargeBlockSize)
+		for j := 0; j < randLen; j++ {
+			orig = append(orig, uint8(rand.Intn(2)))
+		}
+	}
+	return orig
+}
+
+func TestRunRSDic(t *testing.T) {
+	raw, rsd := initBitVectorFromBits(runBits(40))
+	defer rsd.CloseReader()
+	runTestRSDic("When a bit vector with long runs is assigned", t, rsd, raw)
+
+	Convey("When a bit vector with long runs is queried exhaustively", t, func() {
+		So(rsd.runNum(), ShouldBeGreaterThan, 0)
+		So(rsd.denseBlockLength, ShouldBeLessThan, rsd.rankBlockLength)
+		for i := uint64(0); i < raw.num; i += 7 {
+			So(rsd.Bit(i), ShouldEqual, raw.orig[i] == 1)
+			So(rsd.Rank(i, true), ShouldEqual, raw.ranks[i])
+		}
+		for i := uint64(0); i < raw.oneNum; i += 5 {
+			pos := rsd.Select1(i)
+			So(raw.orig[pos], ShouldEqual, 1)
+			So(raw.ranks[pos], ShouldEqual, i)
+		}
+		for i := uint64(0); i < raw.num-raw.oneNum; i += 5 {
+			pos := rsd.Select0(i)
+			So(raw.orig[pos], ShouldEqual, 0)
+			So(pos-raw.ranks[pos], ShouldEqual, i)
+		}
+		So(rsd.GetWords(0, raw.num, []uint64{}), ShouldResemble, rawWords(raw.orig, 0, raw.num))
+	})
+}
+
+func TestRunOnlyRSDic(t *testing.T) {
+	orig := make([]uint8, 100*kLargeBlockSize+10)
+	for i := 50 * kLargeBlockSize; i < len(orig); i++ {
+		orig[i] = 1
+	}
+	raw, rsd := initBitVectorFromBits(orig)
+	defer rsd.CloseReader()
+	runTestRSDic("When a bit vector of two runs is assigned", t, rsd, raw)
+
+	Convey("The index should not grow with the length of runs", t, func() {
+		So(rsd.runNum(), ShouldEqual, 2)
+		So(rsd.denseBlockLength, ShouldEqual, 0)
+		for _, name := range []string{RANK_SMALL_BLOCK_FN, SELECT_ONE_IND_FN, SELECT_ZERO_IND_FN} {
+			info, err := os.Stat("test/" + name)
+			So(err, ShouldBeNil)
+			So(info.Size(), ShouldEqual, 0)
+		}
+	})
+}
+
+func fileSize(name string) uint64 {
+	info, err := os.Stat("test/" + name)
+	if err != nil {
+		panic(err)
+	}
+	return uint64(info.Size())
+}
+
+// legacyBits returns the bits of testdata/v0, which was written by PushBack
+// before runs were introduced (format version 0).
+func legacyBits() []uint8 {
+	orig := make([]uint8, 5000)
+	for i := range orig {
+		bit := i%97 == 0
+		if i >= 2048 && i < 4096 {
+			bit = i >= 3072
+		}
+		if i >= 4096 {
+			bit = (i*i)%7 < 3
+		}
+		if bit {
+			orig[i] = 1
+		}
+	}
+	return orig
+}
+
+func TestLegacyRSDic(t *testing.T) {
+	Convey("When a directory of format version 0 is read", t, func() {
+		meta, err := os.ReadFile("testdata/v0/metadata.bin")
+		So(err, ShouldBeNil)
+		rsd, err := New("testdata/v0")
+		So(err, ShouldBeNil)
+		So(rsd.UnmarshalBinary(meta), ShouldBeNil)
+		So(rsd.LoadReader(), ShouldBeNil)
+		checkRSDic(rsd, legacyBits())
+		So(rsd.CloseReader(), ShouldBeNil)
+	})
+
+	Convey("When the metadata is of a newer format version", t, func() {
+		rsd, err := New("test")
+		So(err, ShouldBeNil)
+		var meta []byte
+		var bh codec.MsgpackHandle
+		enc := codec.NewEncoderBytes(&meta, &bh)
+		// the values before the version, as encoded by MarshalBinary
+		for _, val := range []interface{}{rsd.bits, rsd.num, rsd.oneNum, rsd.zeroNum, rsd.lastBlock,
+			rsd.lastOneNum, rsd.lastZeroNum, rsd.codeLen, rsd.bits.writeBits, rsd.bits.writeBitsSize,
+			rsd.bits.isSet, rsd.bits.numWritten, rsd.rankBlockLength, rsd.rankSmBlockLength,
+			uint8(kFormatVersion + 1)} {
+			So(enc.Encode(val), ShouldBeNil)
+		}
+		err = rsd.UnmarshalBinary(meta)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "format version")
+	})
+}
+
+func TestStats(t *testing.T) {
+	orig := runBits(10)
+	for i := 0; i < 5000; i++ {
+		orig = append(orig, uint8(rand.Intn(2)))
+	}
+	raw, rsd := initBitVectorFromBits(orig)
+	defer rsd.CloseReader()
+	Convey("When the statistics of a bit vector are computed", t, func() {
+		st := rsd.Stats()
+		So(st.Num, ShouldEqual, raw.num)
+		So(st.OneNum, ShouldEqual, raw.oneNum)
+		So(st.PointerBytes, ShouldEqual, fileSize(POINTER_BLOCK_FN))
+		So(st.RankBytes, ShouldEqual, fileSize(RANK_BLOCK_FN))
+		So(st.SelectOneBytes, ShouldEqual, fileSize(SELECT_ONE_IND_FN))
+		So(st.SelectZeroBytes, ShouldEqual, fileSize(SELECT_ZERO_IND_FN))
+		So(st.RankSmallBytes, ShouldEqual, fileSize(RANK_SMALL_BLOCK_FN))
+		So(st.RunBytes, ShouldEqual, fileSize(RUN_BLOCK_FN))
+		So(st.BitsBytes, ShouldBeGreaterThanOrEqualTo, fileSize(BITS_FN))
+		So(st.TotalBytes, ShouldEqual, uint64(rsd.AllocSize()))
+		So(st.RunNum, ShouldBeGreaterThan, 0)
+
+		popCounts := [65]uint64{}
+		for i := uint64(0); i < (raw.num-1)/kSmallBlockSize*kSmallBlockSize; i += kSmallBlockSize {
+			popCounts[raw.ranks[i+kSmallBlockSize]-raw.ranks[i]]++
+		}
+		So(st.PopCountHistogram, ShouldResemble, popCounts)
+		codeLens := uint64(0)
+		for _, n := range st.CodeLenHistogram {
+			codeLens += n
+		}
+		So(codeLens, ShouldEqual, rsd.rankSmBlockLength)
+		So(st.RawBlockNum+st.EnumBlockNum, ShouldEqual, rsd.rankSmBlockLength)
+		So(st.RawBlockNum, ShouldEqual, st.CodeLenHistogram[64])
+	})
+
+	Convey("When the statistics are computed without a reader", t, func() {
+		st := rsd.Stats()
+		noReader := *rsd
+		noReader.reader = nil
+		sizes := noReader.Stats()
+		So(sizes.TotalBytes, ShouldEqual, st.TotalBytes)
+		So(sizes.RunNum, ShouldEqual, st.RunNum)
+		So(sizes.RawBlockNum+sizes.EnumBlockNum, ShouldEqual, 0)
+	})
+}
+
+func TestLogicalOps(t *testing.T) {
+	origA := runBits(10)
+	origB := runBits(10)
+	num := min(len(origA), len(origB)) - 17
+	origA, origB = origA[:num], origB[:num]
+	_, a := initBitVectorAt("test/a", origA)
+	defer a.CloseReader()
+	_, b := initBitVectorAt("test/b", origB)
+	defer b.CloseReader()
+
+	ops := []struct {
+		name string
+		f    func(a, b *RSDic, outPath string) (*RSDic, error)
+		op   func(x, y uint8) uint8
+	}{
+		{"And", And, func(x, y uint8) uint8 { return x & y }},
+		{"Or", Or, func(x, y uint8) uint8 { return x | y }},
+		{"Xor", Xor, func(x, y uint8) uint8 { return x ^ y }},
+		{"AndNot", AndNot, func(x, y uint8) uint8 { return x &^ y }},
+		{"Not", func(a, _ *RSDic, outPath string) (*RSDic, error) { return Not(a, outPath) },
+			func(x, _ uint8) uint8 { return 1 - x }},
+	}
+	for _, op := range ops {
+		expected := make([]uint8, num)
+		for i := range expected {
+			expected[i] = op.op(origA[i], origB[i])
+		}
+		rsd, err := op.f(a, b, "test/"+op.name)
+		Convey("When "+op.name+" of two bit vectors is computed", t, func() {
+			So(err, ShouldBeNil)
+			So(rsd.GetWords(0, uint64(num), []uint64{}), ShouldResemble, rawWords(expected, 0, uint64(num)))
+		})
+		runTestRSDic("When the result of "+op.name+" is queried", t, rsd, newRawBitVector(expected))
+	}
+
+	_, c := initBitVectorAt("test/c", origA[:num-1])
+	defer c.CloseReader()
+	Convey("When the lengths of two bit vectors differ", t, func() {
+		_, err := And(a, c, "test/And")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestLogicalCounts(t *testing.T) {
+	origA := runBits(10)
+	origB := runBits(10)
+	num := min(len(origA), len(origB)) - 17
+	origA, origB = origA[:num], origB[:num]
+	for i := 0; i < num/3; i++ {
+		origB[i] = uint8(rand.Intn(2))
+	}
+	_, a := initBitVectorAt("test/a", origA)
+	defer a.CloseReader()
+	_, b := initBitVectorAt("test/b", origB)
+	defer b.CloseReader()
+
+	Convey("When the cardinalities of logical operations are computed", t, func() {
+		and, or, xor := uint64(0), uint64(0), uint64(0)
+		for i := 0; i < num; i++ {
+			and += uint64(origA[i] & origB[i])
+			or += uint64(origA[i] | origB[i])
+			xor += uint64(origA[i] ^ origB[i])
+		}
+		count, err := AndCount(a, b)
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, and)
+		count, err = OrCount(a, b)
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, or)
+		count, err = XorCount(a, b)
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, xor)
+		jaccard, err := Jaccard(a, b)
+		So(err, ShouldBeNil)
+		So(jaccard, ShouldAlmostEqual, float64(and)/float64(or))
+
+		count, err = AndCount(a, a)
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, a.OneNum())
+		count, err = XorCount(a, a)
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 0)
+	})
+
+	_, c := initBitVectorAt("test/c", make([]uint8, 100))
+	defer c.CloseReader()
+	_, d := initBitVectorAt("test/d", make([]uint8, 100))
+	defer d.CloseReader()
+	Convey("When the Jaccard similarity of bit vectors without ones is computed", t, func() {
+		jaccard, err := Jaccard(c, d)
+		So(err, ShouldBeNil)
+		So(jaccard, ShouldEqual, 1)
+		_, err = AndCount(a, c)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+// sameFiles returns whether the streams of two RSDic directories are identical.
+func sameFiles(dirA string, dirB string) bool {
+	for _, name := range []string{BITS_FN, POINTER_BLOCK_FN, RANK_BLOCK_FN, SELECT_ONE_IND_FN,
+		SELECT_ZERO_IND_FN, RANK_SMALL_BLOCK_FN, RUN_BLOCK_FN} {
+		a, err := os.ReadFile(dirA + "/" + name)
+		if err != nil {
+			panic(err)
+		}
+		b, err := os.ReadFile(dirB + "/" + name)
+		if err != nil {
+			panic(err)
+		}
+		if !bytes.Equal(a, b) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestConcat(t *testing.T) {
+	lengths := []int{5000, 120, 3 * kLargeBlockSize, 0, 100, 28, 7 * kSmallBlockSize, 1}
+	parts := []*RSDic{}
+	orig := []uint8{}
+	for i, length := range lengths {
+		bits := runBits(3)
+		for len(bits) < length {
+			bits = append(bits, runBits(3)...)
+		}
+		bits = bits[:length]
+		if i%2 == 1 {
+			for j := range bits {
+				bits[j] = uint8(rand.Intn(2))
+			}
+		}
+		_, part := initBitVectorAt(fmt.Sprintf("test/part%d", i), bits)
+		defer part.CloseReader()
+		parts = append(parts, part)
+		orig = append(orig, bits...)
+	}
+	_, seq := initBitVectorAt("test/seq", orig)
+	defer seq.CloseReader()
+	rsd, err := Concat("test/concat", parts...)
+
+	Convey("When bit vectors are concatenated", t, func() {
+		So(err, ShouldBeNil)
+		So(rsd.GetWords(0, uint64(len(orig)), []uint64{}), ShouldResemble, rawWords(orig, 0, uint64(len(orig))))
+		seqOut, err := seq.MarshalBinary()
+		So(err, ShouldBeNil)
+		out, err := rsd.MarshalBinary()
+		So(err, ShouldBeNil)
+		So(out, ShouldResemble, seqOut)
+		So(sameFiles("test/concat", "test/seq"), ShouldBeTrue)
+	})
+	runTestRSDic("When the concatenation is queried", t, rsd, newRawBitVector(orig))
+}
+
+// packBits returns orig packed into little-endian 64-bit words,
+// truncated to the bytes containing the bits.
+func packBits(orig []uint8) []byte {
+	buf := []byte{}
+	for _, word := range rawWords(orig, 0, uint64(len(orig))) {
+		buf = binary.LittleEndian.AppendUint64(buf, word)
+	}
+	return buf[:(len(orig)+7)/8]
+}
+
+func TestBuildParallel(t *testing.T) {
+	orig := runBits(20)
+	for i := 0; i < 50000; i++ {
+		orig = append(orig, uint8(rand.Intn(2)))
+	}
+	orig = orig[:len(orig)-13]
+	_, seq := initBitVectorAt("test/seq", orig)
+	defer seq.CloseReader()
+	rsd, err := BuildParallel("test/parallel", bytes.NewReader(packBits(orig)), uint64(len(orig)), 4)
+
+	Convey("When a bit vector is built in parallel", t, func() {
+		So(err, ShouldBeNil)
+		seqOut, err := seq.MarshalBinary()
+		So(err, ShouldBeNil)
+		out, err := rsd.MarshalBinary()
+		So(err, ShouldBeNil)
+		So(out, ShouldResemble, seqOut)
+		So(sameFiles("test/parallel", "test/seq"), ShouldBeTrue)
+		entries, err := os.ReadDir("test/parallel")
+		So(err, ShouldBeNil)
+		for _, entry := range entries {
+			So(entry.IsDir(), ShouldBeFalse)
+		}
+	})
+	runTestRSDic("When the bit vector built in parallel is queried", t, rsd, newRawBitVector(orig))
+
+	Convey("When an empty or short bit vector is built in parallel", t, func() {
+		So(rsd.CloseReader(), ShouldBeNil)
+		empty, err := BuildParallel("test/parallel", bytes.NewReader(nil), 0, 4)
+		So(err, ShouldBeNil)
+		So(empty.Num(), ShouldEqual, 0)
+		So(empty.CloseReader(), ShouldBeNil)
+		_, err = BuildParallel("test/parallel", bytes.NewReader(packBits(orig[:100])), 200, 4)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When a segment fails while built in parallel", t, func() {
+		errRead := errors.New("read failed")
+		src := &failingReaderAt{failAt: 0, err: errRead}
+		nbits := uint64(1 << 24)
+		_, err := BuildParallel("test/parallel", src, nbits, 4)
+		So(err, ShouldEqual, errRead)
+		// the other segments stop early
+		So(src.read.Load(), ShouldBeLessThan, nbits/8/2)
+		entries, err := os.ReadDir("test/parallel")
+		So(err, ShouldBeNil)
+		for _, entry := range entries {
+			So(entry.IsDir(), ShouldBeFalse)
+		}
+	})
+}
+
+// failingReaderAt reads zeros slowly, failing for reads at failAt.
+type failingReaderAt struct {
+	failAt int64
+	err    error
+	read   atomic.Uint64 // the number of bytes read
+}
+
+func (r *failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off == r.failAt {
+		return 0, r.err
+	}
+	time.Sleep(time.Millisecond)
+	clear(p)
+	r.read.Add(uint64(len(p)))
+	return len(p), nil
+}
+
+func TestBuildFromReader(t *testing.T) {
+	orig := runBits(10)
+	for i := 0; i < 10000; i++ {
+		orig = append(orig, uint8(rand.Intn(2)))
+	}
+	orig = orig[:len(orig)-len(orig)%8]
+	_, seq := initBitVectorAt("test/seq", orig)
+	defer seq.CloseReader()
+	packed := packBits(orig)
+	if err := os.WriteFile("test/bitmap", packed, 0666); err != nil {
+		panic(err)
+	}
+
+	Convey("When a bit vector is built from a reader or a file", t, func() {
+		rsd, err := BuildFromReader("test/reader", bytes.NewReader(packed), uint64(len(orig))-5)
+		So(err, ShouldBeNil)
+		So(rsd.GetWords(0, rsd.Num(), []uint64{}), ShouldResemble, rawWords(orig, 0, uint64(len(orig))-5))
+
+		rsd, err = BuildFromFile("test/file", "test/bitmap")
+		So(err, ShouldBeNil)
+		seqOut, err := seq.MarshalBinary()
+		So(err, ShouldBeNil)
+		out, err := rsd.MarshalBinary()
+		So(err, ShouldBeNil)
+		So(out, ShouldResemble, seqOut)
+		So(sameFiles("test/file", "test/seq"), ShouldBeTrue)
+
+		_, err = BuildFromReader("test/reader", bytes.NewReader(packed), uint64(len(orig))+64)
+		So(err, ShouldNotBeNil)
+		_, err = BuildFromFile("test/file", "test/no_such_file")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+// checkRSDic checks all bits, ranks and selects of rsd against orig.
+func checkRSDic(rsd *RSDic, orig []uint8) {
+	raw := newRawBitVector(orig)
+	So(rsd.Num(), ShouldEqual, raw.num)
+	So(rsd.OneNum(), ShouldEqual, raw.oneNum)
+	So(rsd.GetWords(0, raw.num, []uint64{}), ShouldResemble, rawWords(orig, 0, raw.num))
+	for i := uint64(0); i < raw.num; i++ {
+		bit, rank := rsd.BitAndRank(i)
+		if bit != (orig[i] == 1) || rank != bitNum(raw.ranks[i], i, bit) || rsd.Select(rank, bit) != i {
+			So(bit, ShouldEqual, orig[i] == 1)
+			So(rank, ShouldEqual, bitNum(raw.ranks[i], i, bit))
+			So(rsd.Select(rank, bit), ShouldEqual, i)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	orig := runBits(6)
+	for i := 0; i < 3000; i++ {
+		orig = append(orig, uint8(rand.Intn(2)))
+	}
+	rsd, err := New("test")
+	if err != nil {
+		panic(err)
+	}
+	rsd.LoadWriter()
+	defer rsd.CloseWriter()
+	for _, bit := range orig {
+		rsd.PushBack(bit == 1)
+	}
+	rsd.LoadReader()
+
+	Convey("When bits are set", t, func() {
+		for i := 0; i < 300; i++ {
+			pos := rand.Intn(len(orig))
+			if i%3 == 0 {
+				// a run of several large blocks
+				pos = rand.Intn(min(len(orig), 10*kLargeBlockSize))
+			}
+			bit := rand.Intn(2) == 1
+			So(rsd.Set(uint64(pos), bit), ShouldBeNil)
+			orig[pos] = 0
+			if bit {
+				orig[pos] = 1
+			}
+			if i%50 == 0 {
+				checkRSDic(rsd, orig)
+			}
+		}
+		checkRSDic(rsd, orig)
+		So(rsd.Stats().UpdateNum, ShouldBeGreaterThan, 0)
+		So(rsd.Set(uint64(len(orig)), true), ShouldNotBeNil)
+	})
+
+	Convey("When bits are set after taking a copy and a snapshot", t, func() {
+		before := append([]uint8{}, orig...)
+		cp := *rsd
+		snap, err := rsd.Snapshot()
+		So(err, ShouldBeNil)
+		defer snap.CloseReader()
+		for i := 0; i < 20; i++ {
+			pos := rand.Intn(len(orig))
+			So(rsd.Set(uint64(pos), orig[pos] == 0), ShouldBeNil)
+			orig[pos] = 1 - orig[pos]
+		}
+		checkRSDic(rsd, orig)
+		checkRSDic(&cp, before)
+		checkRSDic(snap, before)
+	})
+
+	Convey("When the updates are written by Concat and the logical operations", t, func() {
+		cat, err := Concat("test/setconcat", rsd)
+		So(err, ShouldBeNil)
+		So(cat.Stats().UpdateNum, ShouldEqual, 0)
+		checkRSDic(cat, orig)
+		and, err := And(rsd, cat, "test/setand")
+		So(err, ShouldBeNil)
+		checkRSDic(and, orig)
+		count, err := AndCount(rsd, rsd)
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, newRawBitVector(orig).oneNum)
+	})
+
+	Convey("When bits are pushed back after setting bits", t, func() {
+		for i := 0; i < 5*kLargeBlockSize; i++ {
+			bit := uint8(0)
+			if i > 2*kLargeBlockSize {
+				bit = uint8(rand.Intn(2))
+			}
+			orig = append(orig, bit)
+			rsd.PushBack(bit == 1)
+		}
+		So(rsd.CloseReader(), ShouldBeNil)
+		So(rsd.LoadReader(), ShouldBeNil)
+		So(rsd.Set(uint64(len(orig)-2*kLargeBlockSize), true), ShouldBeNil)
+		orig[len(orig)-2*kLargeBlockSize] = 1
+		checkRSDic(rsd, orig)
+	})
+	runTestRSDic("When the bit vector after setting bits is queried", t, rsd, newRawBitVector(orig))
+
+	Convey("When the bit vector is truncated after setting bits", t, func() {
+		newNum := len(orig) - 3*kLargeBlockSize - 10
+		So(rsd.Set(uint64(newNum-1), orig[newNum-1] == 0), ShouldBeNil)
+		orig[newNum-1] = 1 - orig[newNum-1]
+		So(rsd.Set(uint64(newNum+5), orig[newNum+5] == 0), ShouldBeNil)
+		So(rsd.Truncate(uint64(newNum)), ShouldBeNil)
+		orig = orig[:newNum]
+		checkRSDic(rsd, orig)
+		for i := 0; i < 2*kSmallBlockSize; i++ {
+			orig = append(orig, uint8(i%3%2))
+			rsd.PushBack(i%3%2 == 1)
+		}
+		So(rsd.CloseReader(), ShouldBeNil)
+		So(rsd.LoadReader(), ShouldBeNil)
+		checkRSDic(rsd, orig)
+	})
+
+	Convey("When bits are set in the last run and the last large block", t, func() {
+		orig := []uint8{}
+		for i := 0; i < 2048; i++ {
+			orig = append(orig, uint8(rand.Intn(2)))
+		}
+		for i := 0; i < 6*kLargeBlockSize; i++ {
+			orig = append(orig, 1)
+		}
+		for i := 0; i < 300; i++ {
+			orig = append(orig, uint8(rand.Intn(2)))
+		}
+		_, rsd := initBitVectorAt("test/openrun", orig)
+		defer rsd.CloseReader()
+		So(rsd.hasOpenRun, ShouldBeTrue)
+		for _, pos := range []int{len(orig) - 300 - 1, 3000, 2048 + 3*kLargeBlockSize, 4000,
+			len(orig) - 200, len(orig) - 1, 2048 + 5*kLargeBlockSize + 7} {
+			So(rsd.Set(uint64(pos), orig[pos] == 0), ShouldBeNil)
+			orig[pos] = 1 - orig[pos]
+			checkRSDic(rsd, orig)
+		}
+	})
+}
+
+func TestTruncate(t *testing.T) {
+	orig := runBits(8)
+	for i := 0; i < 3000; i++ {
+		orig = append(orig, uint8(rand.Intn(2)))
+	}
+	os.MkdirAll("test/truncate", 0777)
+	rsd, err := New("test/truncate")
+	if err != nil {
+		panic(err)
+	}
+	rsd.LoadWriter()
+	defer rsd.CloseWriter()
+	for _, bit := range orig {
+		rsd.PushBack(bit == 1)
+	}
+	rsd.LoadReader()
+
+	Convey("When a bit vector is truncated", t, func() {
+		lengths := []int{len(orig), len(orig) - 1, len(orig) - 100, 20 * kLargeBlockSize,
+			20*kLargeBlockSize - kSmallBlockSize, 10*kLargeBlockSize + 1, 3000, 1024, 64, 63, 1}
+		for _, length := range lengths {
+			if length > len(orig) {
+				continue
+			}
+			So(rsd.Truncate(uint64(length)), ShouldBeNil)
+			orig = orig[:length]
+			_, seq := initBitVectorAt("test/seq", orig)
+			seqOut, err := seq.MarshalBinary()
+			So(err, ShouldBeNil)
+			So(seq.CloseReader(), ShouldBeNil)
+			out, err := rsd.MarshalBinary()
+			So(err, ShouldBeNil)
+			So(out, ShouldResemble, seqOut)
+			So(sameFiles("test/truncate", "test/seq"), ShouldBeTrue)
+			checkRSDic(rsd, orig)
+		}
+		So(rsd.Truncate(uint64(len(orig))+1), ShouldNotBeNil)
+	})
+
+	Convey("When bits are pushed back after truncation", t, func() {
+		So(rsd.Truncate(0), ShouldBeNil)
+		So(rsd.Num(), ShouldEqual, 0)
+		orig = runBits(3)
+		for _, bit := range orig {
+			rsd.PushBack(bit == 1)
+		}
+		So(rsd.Truncate(uint64(len(orig)/2)), ShouldBeNil)
+		orig = orig[:len(orig)/2]
+		for i := 0; i < 3000; i++ {
+			bit := uint8(rand.Intn(2))
+			orig = append(orig, bit)
+			rsd.PushBack(bit == 1)
+		}
+		_, seq := initBitVectorAt("test/seq", orig)
+		defer seq.CloseReader()
+		seqOut, err := seq.MarshalBinary()
+		So(err, ShouldBeNil)
+		out, err := rsd.MarshalBinary()
+		So(err, ShouldBeNil)
+		So(out, ShouldResemble, seqOut)
+		So(rsd.reloadFiles(), ShouldBeNil)
+		So(sameFiles("test/truncate", "test/seq"), ShouldBeTrue)
+		checkRSDic(rsd, orig)
+	})
+
+	Convey("When a bit vector without its writer is truncated", t, func() {
+		_, other := initBitVectorAt("test/other", orig)
+		defer other.CloseReader()
+		So(other.Truncate(1), ShouldNotBeNil)
+		checkRSDic(other, orig)
+	})
+}
+
+func TestConcurrent(t *testing.T) {
+	orig := runBits(20)
+	raw, rsd := initBitVectorAt("test/concurrent", orig)
+	defer rsd.CloseReader()
+
+	Convey("When a bit vector is queried by many goroutines", t, func() {
+		var wg sync.WaitGroup
+		errs := make([]int, 8)
+		for g := range errs {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 2000; i++ {
+					pos := uint64(rand.Int63n(int64(raw.num)))
+					bit, rank := rsd.BitAndRank(pos)
+					if bit != (raw.orig[pos] == 1) || rsd.Rank(pos, true) != raw.ranks[pos] ||
+						rsd.Select(rank, bit) != pos {
+						errs[g]++
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		So(errs, ShouldResemble, make([]int, 8))
+	})
+
+	Convey("When a bit vector is queried while it grows", t, func() {
+		os.MkdirAll("test/growing", 0777)
+		rsd, err := New("test/growing")
+		So(err, ShouldBeNil)
+		So(rsd.LoadWriter(), ShouldBeNil)
+		defer rsd.CloseWriter()
+		defer rsd.CloseReader()
+		c := NewConcurrent(rsd)
+
+		var wg sync.WaitGroup
+		errs := make([]int, 4)
+		for g := range errs {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 5000; i++ {
+					runtime.Gosched()
+					num := c.Num()
+					if num == 0 {
+						continue
+					}
+					pos := uint64(rand.Int63n(int64(num)))
+					bit, rank := c.BitAndRank(pos)
+					if bit != (raw.orig[pos] == 1) || c.Rank(pos, true) != raw.ranks[pos] ||
+						c.Select(rank, bit) != pos {
+						errs[g]++
+					}
+				}
+			}(g)
+		}
+		for i, bit := range orig {
+			c.PushBack(bit == 1)
+			if i%kSmallBlockSize == 0 {
+				runtime.Gosched() // let the readers query while it grows
+			}
+		}
+		wg.Wait()
+		So(errs, ShouldResemble, make([]int, 4))
+		So(c.Num(), ShouldEqual, raw.num)
+		So(c.OneNum(), ShouldEqual, raw.oneNum)
+		So(c.View(func(rs *RSDic) { checkRSDic(rs, orig) }), ShouldBeNil)
+
+		So(c.Set(0, orig[0] == 0), ShouldBeNil)
+		So(c.Bit(0), ShouldEqual, orig[0] == 0)
+		So(c.Truncate(raw.num/2), ShouldBeNil)
+		So(c.Num(), ShouldEqual, raw.num/2)
+		oneNum := raw.ranks[raw.num/2] + 1
+		if orig[0] == 1 {
+			oneNum -= 2
+		}
+		So(c.Rank(raw.num/2, true), ShouldEqual, oneNum)
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	orig := runBits(10)
+	os.MkdirAll("test/snapshot", 0777)
+	rsd, err := New("test/snapshot")
+	if err != nil {
+		panic(err)
+	}
+	rsd.LoadWriter()
+	defer rsd.CloseWriter()
+
+	Convey("When snapshots are taken while bits are pushed back", t, func() {
+		snaps := []*RSDic{}
+		lengths := []int{}
+		for i, bit := range orig {
+			if i%5000 == 0 || i == len(orig)-1 {
+				snap, err := rsd.Snapshot()
+				So(err, ShouldBeNil)
+				snaps = append(snaps, snap)
+				lengths = append(lengths, i)
+			}
+			rsd.PushBack(bit == 1)
+		}
+		for i, snap := range snaps {
+			So(snap.Num(), ShouldEqual, lengths[i])
+			checkRSDic(snap, orig[:lengths[i]])
+			So(snap.CloseReader(), ShouldBeNil)
+		}
+	})
+
+	Convey("When a snapshot is modified", t, func() {
+		snap, err := rsd.Snapshot()
+		So(err, ShouldBeNil)
+		defer snap.CloseReader()
+		So(snap.Set(0, true), ShouldEqual, errReadOnly)
+		So(snap.Truncate(0), ShouldEqual, errReadOnly)
+		So(snap.LoadWriter(), ShouldEqual, errReadOnly)
+		So(func() { snap.PushBack(true) }, ShouldPanic)
+		So(snap.Num(), ShouldEqual, len(orig))
+	})
+
+	Convey("When snapshots are taken by many goroutines while bits are pushed back", t, func() {
+		os.MkdirAll("test/growing", 0777)
+		rsd, err := New("test/growing")
+		So(err, ShouldBeNil)
+		So(rsd.LoadWriter(), ShouldBeNil)
+		defer rsd.CloseWriter()
+		defer rsd.CloseReader()
+		c := NewConcurrent(rsd)
+		raw := newRawBitVector(orig)
+
+		var wg sync.WaitGroup
+		errs := make([]int, 4)
+		for g := range errs {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					runtime.Gosched()
+					snap, err := c.Snapshot()
+					if err != nil {
+						errs[g]++
+						continue
+					}
+					for j := 0; j < 20 && snap.Num() > 0; j++ {
+						pos := uint64(rand.Int63n(int64(snap.Num())))
+						bit, rank := snap.BitAndRank(pos)
+						if bit != (raw.orig[pos] == 1) || rank != bitNum(raw.ranks[pos], pos, bit) ||
+							snap.OneNum() != raw.ranks[snap.Num()-1]+uint64(raw.orig[snap.Num()-1]) {
+							errs[g]++
+						}
+					}
+					snap.CloseReader()
+				}
+			}(g)
+		}
+		for i, bit := range orig {
+			c.PushBack(bit == 1)
+			if i%kSmallBlockSize == 0 {
+				runtime.Gosched()
+			}
+		}
+		wg.Wait()
+		So(errs, ShouldResemble, make([]int, 4))
+	})
+}
+
+func TestContext(t *testing.T) {
+	orig := runBits(20)
+	for i := 0; i < 50000; i++ {
+		orig = append(orig, uint8(rand.Intn(2)))
+	}
+	raw, a := initBitVectorAt("test/context", orig)
+	defer a.CloseReader()
+	notOrig := make([]uint8, len(orig))
+	for i, bit := range orig {
+		notOrig[i] = 1 - bit
+	}
+
+	// cancelHalfway returns a context recording the progress, which is cancelled
+	// when half of the bits are processed
+	cancelHalfway := func(progress *[]uint64) context.Context {
+		ctx, cancel := context.WithCancel(context.Background())
+		return WithProgress(ctx, func(done uint64, total uint64) {
+			*progress = append(*progress, done)
+			if done > total/2 {
+				cancel()
+			}
+		})
+	}
+	noFiles := func(dir string) bool {
+		entries, err := os.ReadDir(dir)
+		return err == nil && len(entries) == 0
+	}
+
+	Convey("When the progress of a logical operation is reported", t, func() {
+		progress := []uint64{}
+		ctx := WithProgress(context.Background(), func(done uint64, total uint64) {
+			So(total, ShouldEqual, raw.num)
+			progress = append(progress, done)
+		})
+		out, err := NotContext(ctx, a, "test/ctxout")
+		So(err, ShouldBeNil)
+		checkRSDic(out, notOrig)
+		So(len(progress), ShouldEqual, floor(raw.num, kLargeBlockSize))
+		So(sort.SliceIsSorted(progress, func(i, j int) bool { return progress[i] < progress[j] }), ShouldBeTrue)
+		So(progress[len(progress)-1], ShouldEqual, raw.num)
+		So(out.CloseReader(), ShouldBeNil)
+
+		progress = progress[:0]
+		count, err := AndCountContext(ctx, a, a)
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, raw.oneNum)
+		So(progress[len(progress)-1], ShouldEqual, raw.num)
+		So(len(progress), ShouldBeLessThanOrEqualTo, floor(raw.num, kLargeBlockSize))
+	})
+
+	Convey("When bulk operations are cancelled", t, func() {
+		progress := []uint64{}
+		_, err := AndContext(cancelHalfway(&progress), a, a, "test/ctxout")
+		So(err, ShouldEqual, context.Canceled)
+		So(progress[len(progress)-1], ShouldBeLessThan, raw.num)
+		So(noFiles("test/ctxout"), ShouldBeTrue)
+
+		_, err = ConcatContext(cancelHalfway(&progress), "test/ctxout", a, a)
+		So(err, ShouldEqual, context.Canceled)
+		So(noFiles("test/ctxout"), ShouldBeTrue)
+
+		_, err = JaccardContext(cancelHalfway(&progress), a, a)
+		So(err, ShouldEqual, context.Canceled)
+
+		var buf bytes.Buffer
+		So(a.DecodeAllContext(cancelHalfway(&progress), &buf), ShouldEqual, context.Canceled)
+		So(buf.Len(), ShouldBeLessThan, len(packBits(orig)))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = OrContext(ctx, a, a, "test/ctxout")
+		So(err, ShouldEqual, context.Canceled)
+		So(noFiles("test/ctxout"), ShouldBeTrue)
+
+		// a directory created by the operation is removed
+		os.RemoveAll("test/ctxnew")
+		_, err = OrContext(ctx, a, a, "test/ctxnew")
+		So(err, ShouldEqual, context.Canceled)
+		_, err = os.Stat("test/ctxnew")
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+
+	Convey("When builds are cancelled", t, func() {
+		progress := []uint64{}
+		src := packBits(orig)
+		_, err := BuildFromReaderContext(cancelHalfway(&progress), "test/ctxout", bytes.NewReader(src), raw.num)
+		So(err, ShouldEqual, context.Canceled)
+		So(noFiles("test/ctxout"), ShouldBeTrue)
+
+		progress = progress[:0]
+		_, err = BuildParallelContext(cancelHalfway(&progress), "test/ctxout", bytes.NewReader(src), raw.num, 4)
+		So(err, ShouldEqual, context.Canceled)
+		So(progress[len(progress)-1], ShouldBeLessThan, raw.num)
+		So(noFiles("test/ctxout"), ShouldBeTrue)
+
+		os.RemoveAll("test/ctxnew")
+		_, err = BuildFromReaderContext(cancelHalfway(&progress), "test/ctxnew", bytes.NewReader(src), raw.num)
+		So(err, ShouldEqual, context.Canceled)
+		_, err = os.Stat("test/ctxnew")
+		So(os.IsNotExist(err), ShouldBeTrue)
+		_, err = BuildParallelContext(cancelHalfway(&progress), "test/ctxnew", bytes.NewReader(src), raw.num, 4)
+		So(err, ShouldEqual, context.Canceled)
+		_, err = os.Stat("test/ctxnew")
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		progress = progress[:0]
+		ctx := WithProgress(context.Background(), func(done uint64, total uint64) {
+			progress = append(progress, done)
+		})
+		rsd, err := BuildParallelContext(ctx, "test/ctxout", bytes.NewReader(src), raw.num, 4)
+		So(err, ShouldBeNil)
+		checkRSDic(rsd, orig)
+		So(progress[len(progress)-1], ShouldEqual, raw.num)
+		So(rsd.CloseReader(), ShouldBeNil)
+	})
+}
+
 func setupRSDic(num uint64, ratio float32) *RSDic {
 	rsd, err := New("test")
 	if err != nil {
@@ -352,3 +1417,33 @@ func BenchmarkSparseRSDicSelect(b *testing.B) {
 		rsd.Select(uint64(rand.Int31n(int32(oneNum))), true)
 	}
 }
+
+const (
+	denseN = 1000000 // 1Mbit 10^6
+)
+
+// A dense random bit vector mostly consists of raw small blocks.
+func BenchmarkDenseRandomRSDicBit(b *testing.B) {
+	rsd := setupRSDic(denseN, 0.5)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rsd.Bit(uint64(rand.Int31n(int32(denseN))))
+	}
+}
+
+func BenchmarkDenseRandomRSDicRank(b *testing.B) {
+	rsd := setupRSDic(denseN, 0.5)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rsd.Rank(uint64(rand.Int31n(int32(denseN))), true)
+	}
+}
+
+func BenchmarkDenseRandomRSDicSelect(b *testing.B) {
+	rsd := setupRSDic(denseN, 0.5)
+	oneNum := rsd.OneNum()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rsd.Select(uint64(rand.Int31n(int32(oneNum))), true)
+	}
+}
@@ -0,0 +1,125 @@
+package rsdic
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Set sets B[pos] to bit.
+//
+// The updates are not written to the files but kept in memory as the sorted
+// positions set to one over zeros of the stored bits and cleared to zero over
+// ones of them, which Bit, Rank, Select and the bulk functions merge with the
+// stored bits, and which are saved in the metadata by MarshalBinary. Thus Set
+// takes O(u) time for u updated bits, and each query an additional O(log u)
+// time (Select a binary search over the positions between the stored
+// selects of rank-u and rank+u). It is meant for occasional updates of a few
+// bits; Concat(path, rs) writes a copy of rs with the updates in the files.
+//
+// The reader and the files are left as they are, so that copies of rs and its
+// snapshots keep their bits, and PushBack can continue after Set. Like the
+// queries, Set reads B[pos] through the reader, which must be loaded again
+// to see the bits pushed back after it was loaded.
+func (rs *RSDic) Set(pos uint64, bit bool) error {
+	if rs.readOnly {
+		return errReadOnly
+	}
+	if pos >= rs.num {
+		return fmt.Errorf("rsdic: Set: position %d is out of bounds (num = %d)", pos, rs.num)
+	}
+	rs.update(pos, bit)
+	return nil
+}
+
+// update sets B[pos] to bit in the updates, also of a read-only RSDic (for Delta).
+func (rs *RSDic) update(pos uint64, bit bool) {
+	switch {
+	case rs.Bit(pos) == bit:
+	case containsSorted(rs.sets, pos):
+		rs.sets = withoutSorted(rs.sets, pos)
+	case containsSorted(rs.clears, pos):
+		rs.clears = withoutSorted(rs.clears, pos)
+	case bit:
+		rs.sets = withSorted(rs.sets, pos)
+	default:
+		rs.clears = withSorted(rs.clears, pos)
+	}
+}
+
+// withSorted returns a new slice of vals with val inserted, leaving vals
+// (which may be shared by copies of the RSDic) as it is.
+func withSorted(vals []uint64, val uint64) []uint64 {
+	i := countLess(vals, val)
+	out := make([]uint64, 0, len(vals)+1)
+	out = append(out, vals[:i]...)
+	out = append(out, val)
+	return append(out, vals[i:]...)
+}
+
+// withoutSorted returns a new slice of vals with val removed, leaving vals as it is.
+func withoutSorted(vals []uint64, val uint64) []uint64 {
+	i := countLess(vals, val)
+	out := make([]uint64, 0, len(vals)-1)
+	out = append(out, vals[:i]...)
+	return append(out, vals[i+1:]...)
+}
+
+// countLess returns the number of values less than val.
+func countLess(vals []uint64, val uint64) uint64 {
+	return uint64(sort.Search(len(vals), func(i int) bool { return vals[i] >= val }))
+}
+
+func containsSorted(vals []uint64, val uint64) bool {
+	i := countLess(vals, val)
+	return i < uint64(len(vals)) && vals[i] == val
+}
+
+// updated returns whether any bit has been updated by Set.
+func (rs RSDic) updated() bool {
+	return len(rs.sets) > 0 || len(rs.clears) > 0
+}
+
+// stored returns rs without the updates, i.e. the bits in the files and in memory.
+func (rs RSDic) stored() RSDic {
+	rs.sets = nil
+	rs.clears = nil
+	return rs
+}
+
+func (rs RSDic) updatedBit(pos uint64) bool {
+	if containsSorted(rs.sets, pos) {
+		return true
+	} else if containsSorted(rs.clears, pos) {
+		return false
+	}
+	return rs.stored().Bit(pos)
+}
+
+func (rs RSDic) updatedRank(pos uint64, bit bool) uint64 {
+	pos = min(pos, rs.num)
+	rank := rs.stored().Rank(pos, true) + countLess(rs.sets, pos) - countLess(rs.clears, pos)
+	return bitNum(rank, pos, bit)
+}
+
+// updatedSelect searches the position between the stored selects, since the
+// updates before a position change its rank by at most inc (the updates to bit)
+// or dec (those to the other bit).
+func (rs RSDic) updatedSelect(rank uint64, bit bool) uint64 {
+	if rank >= bitNum(rs.OneNum(), rs.num, bit) {
+		return rs.num
+	}
+	inc, dec := uint64(len(rs.sets)), uint64(len(rs.clears))
+	if !bit {
+		inc, dec = dec, inc
+	}
+	stored := rs.stored()
+	lo := uint64(0)
+	if rank >= inc {
+		lo = stored.Select(rank-inc, bit)
+	}
+	hi := min(stored.Select(rank+dec, bit), rs.num-1)
+	// the smallest pos such that B[0...pos] has more than rank bit's
+	return lo + uint64(sort.Search(int(hi-lo), func(i int) bool {
+		return rs.Rank(lo+uint64(i)+1, bit) > rank
+	}))
+}
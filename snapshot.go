@@ -0,0 +1,54 @@
+package rsdic
+
+import "fmt"
+
+// errReadOnly is returned by the modifications of a snapshot.
+var errReadOnly = fmt.Errorf("rsdic: snapshot is read-only")
+
+// Snapshot returns a read-only RSDic fixed at the current bits of rs,
+// which can be queried while PushBack continues on rs.
+//
+// The snapshot has its own copies of the last small block, the last large
+// block and the write buffer, and maps the files anew, so that it reads only
+// the prefix of each file that existed at snapshot time (PushBack only appends
+// to the files). It has no block cache, and its reader and its shared lock of
+// the directory should be released by CloseReader. Truncate of rs modifies
+// the files in place, so the snapshots of rs must not be used after it.
+//
+// Snapshot must not be called during modifications of rs; use
+// Concurrent.Snapshot to take one while bits are pushed back.
+func (rs *RSDic) Snapshot() (*RSDic, error) {
+	locked, err := lockDir(rs.path, false)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := InitReaders(rs.path)
+	if err != nil {
+		if locked {
+			unlockDir(rs.path, false)
+		}
+		return nil, err
+	}
+	snap := *rs
+	snap.reader = reader
+	snap.readLocked = locked
+	snap.writer = nil
+	snap.writeLocked = false
+	snap.cache = nil
+	snap.readOnly = true
+	snap.bits = &BufferedBits{
+		writeBits:     &[2]uint64{rs.bits.writeBits[0], rs.bits.writeBits[1]},
+		writeBitsSize: rs.bits.writeBitsSize,
+		isSet:         &[2]bool{rs.bits.isSet[0], rs.bits.isSet[1]},
+		numWritten:    rs.bits.numWritten,
+	}
+	snap.pendSmall = append(make([]uint8, 0, kSmallBlockPerLargeBlock), rs.pendSmall...)
+	return &snap, nil
+}
+
+// Snapshot returns a read-only RSDic fixed at the current bits (See RSDic.Snapshot).
+func (c *Concurrent) Snapshot() (*RSDic, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rs.Snapshot()
+}
@@ -0,0 +1,296 @@
+package rsdic
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"path"
+
+	"golang.org/x/exp/mmap"
+)
+
+// Fixed is the constraint of the values of a SparseArray, which are stored
+// with a fixed size.
+type Fixed interface {
+	~int8 | ~uint8 | ~int16 | ~uint16 | ~int32 | ~uint32 | ~int64 | ~uint64 | ~float32 | ~float64
+}
+
+// SparseArray represents an array A[0...num) of values of T, where only some
+// positions have values.
+//
+// The positions with values are marked by the ones of an RSDic in the
+// subdirectory present of the directory, and the values are stored in the
+// order of the positions in values.bin as little-endian fixed-size values,
+// which is mapped for reading, so that the value of A[pos] is the
+// Rank(pos, true)-th one. The number of positions and the metadata of the
+// RSDic are stored in manifest.bin.
+//
+// As the queries don't modify it, SparseArray is safe for concurrent queries.
+// A SparseArrayIterator must not be shared between goroutines.
+type SparseArray[T Fixed] struct {
+	path    string
+	present *RSDic
+	values  *mmap.ReaderAt
+	size    uint64 // the size of a value in bytes
+}
+
+// sparseManifest is the content of manifest.bin.
+type sparseManifest struct {
+	Num     uint64
+	Present []byte // MarshalBinary of the RSDic
+}
+
+const (
+	SPARSE_PRESENT_DIR = "present"
+	SPARSE_VALUES_FN   = "values.bin"
+)
+
+func fixedSize[T Fixed]() uint64 {
+	var val T
+	return uint64(binary.Size(val))
+}
+
+// BuildSparseArray returns a new SparseArray at dir of num positions, whose
+// positions with values and the values are given in the increasing order of
+// the positions by next, with its files written and loaded for reading.
+// next is called until its last result is false.
+func BuildSparseArray[T Fixed](dir string, num uint64, next func() (pos uint64, val T, ok bool)) (*SparseArray[T], error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	present, err := newOpOutput(path.Join(dir, SPARSE_PRESENT_DIR))
+	if err != nil {
+		return nil, err
+	}
+	sa := &SparseArray[T]{path: dir, present: present, size: fixedSize[T]()}
+	if err := sa.writeValues(num, next); err != nil {
+		removeOutput(present)
+		os.Remove(path.Join(dir, SPARSE_VALUES_FN))
+		return nil, err
+	}
+	if err := closeOpOutput(present); err != nil {
+		return nil, err
+	}
+	manifest := sparseManifest{Num: num}
+	meta, err := present.MarshalBinary()
+	if err == nil {
+		manifest.Present = meta
+		err = writeManifest(dir, manifest)
+	}
+	if err == nil {
+		sa.values, err = mmap.Open(path.Join(dir, SPARSE_VALUES_FN))
+	}
+	if err != nil {
+		sa.Close()
+		return nil, err
+	}
+	return sa, nil
+}
+
+// writeValues pushes back the bits of the positions given by next to the
+// writer of the present RSDic, and writes the values to values.bin.
+func (sa *SparseArray[T]) writeValues(num uint64, next func() (uint64, T, bool)) error {
+	f, err := os.Create(path.Join(sa.path, SPARSE_VALUES_FN))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	bw := &bitWriter{out: sa.present}
+	for {
+		pos, val, ok := next()
+		if !ok {
+			break
+		}
+		pushed := bw.pushed()
+		if pos < pushed || pos >= num {
+			f.Close()
+			return fmt.Errorf("rsdic: position %d is not in [%d, %d)", pos, pushed, num)
+		}
+		bw.pushZeros(pos - pushed)
+		bw.push(true)
+		if err := binary.Write(w, binary.LittleEndian, val); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	bw.pushZeros(num - bw.pushed())
+	bw.flush()
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// OpenSparseArray loads the SparseArray at dir written by BuildSparseArray
+// with the same T.
+func OpenSparseArray[T Fixed](dir string) (*SparseArray[T], error) {
+	var manifest sparseManifest
+	if err := readManifest(dir, &manifest); err != nil {
+		return nil, err
+	}
+	present, err := New(path.Join(dir, SPARSE_PRESENT_DIR))
+	if err != nil {
+		return nil, err
+	}
+	if err := present.UnmarshalBinary(manifest.Present); err != nil {
+		return nil, err
+	}
+	if present.Num() != manifest.Num {
+		return nil, fmt.Errorf("rsdic: present bits of %s have length %d for %d positions", dir, present.Num(), manifest.Num)
+	}
+	if err := present.LoadReader(); err != nil {
+		return nil, err
+	}
+	sa := &SparseArray[T]{path: dir, present: present, size: fixedSize[T]()}
+	if sa.values, err = mmap.Open(path.Join(dir, SPARSE_VALUES_FN)); err != nil {
+		sa.Close()
+		return nil, err
+	}
+	if uint64(sa.values.Len()) != present.OneNum()*sa.size {
+		sa.Close()
+		return nil, fmt.Errorf("rsdic: %s of %s has %d bytes for %d values of %d bytes",
+			SPARSE_VALUES_FN, dir, sa.values.Len(), present.OneNum(), sa.size)
+	}
+	return sa, nil
+}
+
+// Close releases the reader of the present bits and the mapping of the values.
+func (sa *SparseArray[T]) Close() error {
+	err := sa.present.CloseReader()
+	if sa.values != nil {
+		if closeErr := sa.values.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Num returns the number of positions
+func (sa *SparseArray[T]) Num() uint64 {
+	return sa.present.Num()
+}
+
+// Count returns the number of positions with values
+func (sa *SparseArray[T]) Count() uint64 {
+	return sa.present.OneNum()
+}
+
+// valueAt returns the (i+1)-th value.
+func (sa *SparseArray[T]) valueAt(i uint64) T {
+	var buf [8]byte
+	if _, err := sa.values.ReadAt(buf[:sa.size], int64(i*sa.size)); err != nil {
+		panic(err)
+	}
+	return decodeFixed[T](buf[:sa.size])
+}
+
+// decodeFixed returns the little-endian value of T in b (as written by binary.Write).
+func decodeFixed[T Fixed](b []byte) T {
+	var u uint64
+	switch len(b) {
+	case 1:
+		u = uint64(b[0])
+	case 2:
+		u = uint64(binary.LittleEndian.Uint16(b))
+	case 4:
+		u = uint64(binary.LittleEndian.Uint32(b))
+	default:
+		u = binary.LittleEndian.Uint64(b)
+	}
+	// the conversion of an integer keeps the low bits (and thus the sign),
+	// while that of a float keeps the value, so floats are converted from their bits
+	var half T = 1
+	if half /= 2; half == 0 {
+		return T(u)
+	} else if len(b) == 4 {
+		return T(math.Float32frombits(uint32(u)))
+	}
+	return T(math.Float64frombits(u))
+}
+
+// Get returns A[pos] and true, or the zero value and false if A[pos] has no value
+func (sa *SparseArray[T]) Get(pos uint64) (T, bool) {
+	if pos >= sa.Num() {
+		panic(fmt.Sprintf("Get: position %d is out of bounds (num = %d)", pos, sa.Num()))
+	}
+	bit, rank := sa.present.BitAndRank(pos)
+	if !bit {
+		var zero T
+		return zero, false
+	}
+	return sa.valueAt(rank), true
+}
+
+// SparseArrayIterator iterates over the positions with values of a SparseArray in order.
+type SparseArrayIterator[T Fixed] struct {
+	sa    *SparseArray[T]
+	wr    *wordReader
+	word  uint64 // the unvisited bits of the current word of the present bits
+	base  uint64 // the position of the current word
+	index uint64 // the index of the next value
+	pos   uint64
+	t     *tracker // of the present bits scanned (IteratorContext only)
+	err   error
+}
+
+// Iterator returns an iterator whose first call of Next moves to the first
+// position at or after pos with a value.
+func (sa *SparseArray[T]) Iterator(pos uint64) *SparseArrayIterator[T] {
+	it := &SparseArrayIterator[T]{sa: sa, index: sa.Count()}
+	if pos < sa.Num() {
+		it.index = sa.present.Rank(pos, true)
+		it.wr = sa.present.newWordReader(pos / kSmallBlockSize)
+		it.base = pos - pos%kSmallBlockSize
+		it.word = it.wr.next() &^ (uint64(1)<<(pos%kSmallBlockSize) - 1)
+	}
+	return it
+}
+
+// IteratorContext is Iterator with cancellation and progress (See context.go),
+// which are checked between large blocks of the present bits scanned by Next.
+// When ctx is done, Next returns false and Err returns ctx.Err().
+func (sa *SparseArray[T]) IteratorContext(ctx context.Context, pos uint64) *SparseArrayIterator[T] {
+	it := sa.Iterator(pos)
+	it.t = newTracker(ctx, sa.Num()-it.base)
+	return it
+}
+
+// Next moves to the next position with a value, and returns false if there are no more.
+func (it *SparseArrayIterator[T]) Next() bool {
+	if it.index >= it.sa.Count() || it.err != nil {
+		return false
+	}
+	for it.word == 0 {
+		if it.t != nil {
+			if it.err = it.t.add(kSmallBlockSize); it.err != nil {
+				return false
+			}
+		}
+		it.word = it.wr.next()
+		it.base += kSmallBlockSize
+	}
+	it.pos = it.base + uint64(bits.TrailingZeros64(it.word))
+	it.word &= it.word - 1
+	it.index++
+	return true
+}
+
+// Err returns the error of the context which stopped the iterator, if any.
+func (it *SparseArrayIterator[T]) Err() error {
+	return it.err
+}
+
+// Pos returns the current position.
+func (it *SparseArrayIterator[T]) Pos() uint64 {
+	return it.pos
+}
+
+// Value returns the value of the current position.
+func (it *SparseArrayIterator[T]) Value() T {
+	return it.sa.valueAt(it.index - 1)
+}
@@ -0,0 +1,165 @@
+package rsdic
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSparseArray(t *testing.T) {
+	num := uint64(200000)
+	vals := map[uint64]float64{}
+	poss := []uint64{}
+	for pos := uint64(0); pos < num; pos++ {
+		// clustered rows with values and long gaps
+		if (pos/5000%3 == 0 && rand.Intn(4) == 0) || rand.Intn(100) == 0 {
+			vals[pos] = rand.NormFloat64()
+			poss = append(poss, pos)
+		}
+	}
+	feed := func(poss []uint64) func() (uint64, float64, bool) {
+		return func() (uint64, float64, bool) {
+			if len(poss) == 0 {
+				return 0, 0, false
+			}
+			pos := poss[0]
+			poss = poss[1:]
+			return pos, vals[pos], true
+		}
+	}
+	built, err := BuildSparseArray("test/sparse", num, feed(poss))
+	if err != nil {
+		panic(err)
+	}
+	defer built.Close()
+
+	checkSparseArray := func(sa *SparseArray[float64]) {
+		So(sa.Num(), ShouldEqual, num)
+		So(sa.Count(), ShouldEqual, len(poss))
+		for n := 0; n < 1000; n++ {
+			pos := uint64(rand.Int63n(int64(num)))
+			val, ok := sa.Get(pos)
+			expected, present := vals[pos]
+			So(ok, ShouldEqual, present)
+			So(val, ShouldEqual, expected)
+		}
+		So(func() { sa.Get(num) }, ShouldPanic)
+
+		it := sa.Iterator(0)
+		for _, pos := range poss {
+			So(it.Next(), ShouldBeTrue)
+			if it.Pos() != pos || it.Value() != vals[pos] {
+				So(it.Pos(), ShouldEqual, pos)
+				So(it.Value(), ShouldEqual, vals[pos])
+			}
+		}
+		So(it.Next(), ShouldBeFalse)
+		k := 1 + rand.Intn(len(poss)-1)
+		it = sa.Iterator(poss[k] - 1)
+		So(it.Next(), ShouldBeTrue)
+		if poss[k-1] == poss[k]-1 {
+			So(it.Pos(), ShouldEqual, poss[k]-1)
+		} else {
+			So(it.Pos(), ShouldEqual, poss[k])
+		}
+		So(sa.Iterator(num).Next(), ShouldBeFalse)
+	}
+
+	Convey("When a sparse array is built", t, func() {
+		checkSparseArray(built)
+	})
+
+	Convey("When a sparse array is opened", t, func() {
+		sa, err := OpenSparseArray[float64]("test/sparse")
+		So(err, ShouldBeNil)
+		defer sa.Close()
+		checkSparseArray(sa)
+	})
+
+	Convey("When an iteration over a sparse array is cancelled", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		it := built.IteratorContext(WithProgress(ctx, func(done uint64, total uint64) {
+			So(total, ShouldEqual, num)
+			if done > total/2 {
+				cancel()
+			}
+		}), 0)
+		n := 0
+		for ; it.Next(); n++ {
+			So(it.Pos(), ShouldEqual, poss[n])
+		}
+		So(it.Err(), ShouldEqual, context.Canceled)
+		So(n, ShouldBeGreaterThan, 0)
+		So(n, ShouldBeLessThan, len(poss))
+
+		it = built.IteratorContext(context.Background(), 0)
+		for n = 0; it.Next(); n++ {
+		}
+		So(it.Err(), ShouldBeNil)
+		So(n, ShouldEqual, len(poss))
+	})
+
+	Convey("When a sparse array has other values or no values", t, func() {
+		type code int16
+		sa, err := BuildSparseArray("test/sparse_small", 10, func() func() (uint64, code, bool) {
+			entries := []uint64{0, 9}
+			return func() (uint64, code, bool) {
+				if len(entries) == 0 {
+					return 0, 0, false
+				}
+				pos := entries[0]
+				entries = entries[1:]
+				return pos, code(-int(pos)), true
+			}
+		}())
+		So(err, ShouldBeNil)
+		val, ok := sa.Get(9)
+		So(ok, ShouldBeTrue)
+		So(val, ShouldEqual, -9)
+		So(sa.Close(), ShouldBeNil)
+
+		_, err = BuildSparseArray("test/sparse_small", 10, feed([]uint64{3, 3}))
+		So(err, ShouldNotBeNil)
+		_, err = BuildSparseArray("test/sparse_small", 10, feed([]uint64{10}))
+		So(err, ShouldNotBeNil)
+		_, err = OpenSparseArray[int32]("test/sparse")
+		So(err, ShouldNotBeNil)
+
+		empty, err := BuildSparseArray("test/sparse_small", 0, feed(nil))
+		So(err, ShouldBeNil)
+		So(empty.Count(), ShouldEqual, 0)
+		So(empty.Iterator(0).Next(), ShouldBeFalse)
+		So(empty.Close(), ShouldBeNil)
+	})
+
+	Convey("When fixed-size values are decoded", t, func() {
+		type celsius float32
+		decoded := func(val any) any {
+			var buf bytes.Buffer
+			binary.Write(&buf, binary.LittleEndian, val)
+			switch val.(type) {
+			case int8:
+				return decodeFixed[int8](buf.Bytes())
+			case uint16:
+				return decodeFixed[uint16](buf.Bytes())
+			case int32:
+				return decodeFixed[int32](buf.Bytes())
+			case int64:
+				return decodeFixed[int64](buf.Bytes())
+			case celsius:
+				return decodeFixed[celsius](buf.Bytes())
+			default:
+				return decodeFixed[float64](buf.Bytes())
+			}
+		}
+		for _, val := range []any{int8(-3), uint16(65000), int32(-123456), int64(-1 << 40),
+			celsius(-2.5), float64(1e100), math.Inf(-1)} {
+			So(decoded(val), ShouldEqual, val)
+		}
+	})
+}
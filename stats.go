@@ -0,0 +1,124 @@
+package rsdic
+
+import (
+	"fmt"
+	"io"
+)
+
+// Stats describes the space used by an RSDic and how its small blocks are encoded.
+//
+// Sizes are those of the stored streams, including the codes in the write buffer,
+// and do not include the last large block and the last small block kept in memory.
+type Stats struct {
+	Num       uint64 // the number of bits
+	OneNum    uint64 // the number of ones
+	UpdateNum uint64 // the number of bits updated by Set, which are kept in memory
+
+	BitsBytes       uint64 // bits.bin: codes of small blocks
+	PointerBytes    uint64 // pointer.bin: code positions of dense large blocks
+	RankBytes       uint64 // rank_block.bin: ranks of dense large blocks
+	SelectOneBytes  uint64 // select_one_ind.bin: select samples of ones
+	SelectZeroBytes uint64 // select_zero_ind.bin: select samples of zeros
+	RankSmallBytes  uint64 // rank_small_block.bin: ranks of small blocks
+	RunBytes        uint64 // run_block.bin: runs of uniform large blocks
+	TotalBytes      uint64 // the sum of the above
+
+	BitsPerBit float64 // TotalBytes*8 / Num
+
+	DenseBlockNum uint64 // the number of stored (dense) large blocks
+	RunNum        uint64 // the number of runs
+	RunBlockNum   uint64 // the number of large blocks in runs
+
+	// The histograms of completed small blocks (including those in runs)
+	// indexed by the number of ones and by the code length.
+	PopCountHistogram [kSmallBlockSize + 1]uint64
+	CodeLenHistogram  [kSmallBlockSize + 1]uint64
+	RawBlockNum       uint64 // the number of small blocks stored raw
+	EnumBlockNum      uint64 // the number of small blocks stored as enumerative codes
+}
+
+// Stats returns the space statistics of rs.
+// This reads all ranks of small blocks, and takes time proportional to Num/64.
+// Without a reader (before LoadReader or after CloseReader), only the sizes and
+// the numbers of dense large blocks and runs are set, and the rest are zero.
+func (rs RSDic) Stats() Stats {
+	st := rs.sizeStats()
+	st.Num = rs.num
+	st.OneNum = rs.OneNum()
+	st.UpdateNum = uint64(len(rs.sets) + len(rs.clears))
+	st.DenseBlockNum = rs.denseBlockLength
+	st.RunNum = rs.runNum()
+	if rs.num > 0 {
+		st.BitsPerBit = float64(st.TotalBytes*8) / float64(rs.num)
+	}
+	if rs.reader == nil {
+		return st
+	}
+
+	addSmallBlocks := func(rankSB uint8, n uint64) {
+		st.PopCountHistogram[rankSB] += n
+		st.CodeLenHistogram[kEnumCodeLength[rankSB]] += n
+		if isRawBlock(rankSB) {
+			st.RawBlockNum += n
+		} else {
+			st.EnumBlockNum += n
+		}
+	}
+	buf := make([]byte, 64*1024)
+	total := int64(rs.denseBlockLength * kSmallBlockPerLargeBlock)
+	for off := int64(0); off < total; off += int64(len(buf)) {
+		chunk := buf[:min(int64(len(buf)), total-off)]
+		if _, err := rs.reader.rankSmallReader.ReadAt(chunk, off); err != nil && err != io.EOF {
+			panic(err)
+		}
+		for _, rankSB := range chunk {
+			addSmallBlocks(rankSB, 1)
+		}
+	}
+	for _, rankSB := range rs.pendSmall {
+		addSmallBlocks(rankSB, 1)
+	}
+	for i := uint64(0); i < rs.runNum(); i++ {
+		run := rs.runAt(i)
+		st.RunBlockNum += run.end - run.start
+		rankSB := uint8(0)
+		if run.bit {
+			rankSB = kSmallBlockSize
+		}
+		addSmallBlocks(rankSB, (run.end-run.start)*kSmallBlockPerLargeBlock)
+	}
+	return st
+}
+
+func (st Stats) String() string {
+	return fmt.Sprintf("%d bits (%d ones): %d bytes (%.2f bits per bit), "+
+		"bits %d, pointer %d, rank %d, select one %d, select zero %d, rank small %d, run %d; "+
+		"%d dense large blocks, %d runs of %d large blocks, %d raw and %d enum small blocks",
+		st.Num, st.OneNum, st.TotalBytes, st.BitsPerBit,
+		st.BitsBytes, st.PointerBytes, st.RankBytes, st.SelectOneBytes, st.SelectZeroBytes,
+		st.RankSmallBytes, st.RunBytes,
+		st.DenseBlockNum, st.RunNum, st.RunBlockNum, st.RawBlockNum, st.EnumBlockNum)
+}
+
+// sizeStats returns Stats with only the sizes set, which are computed from
+// the lengths of the streams.
+func (rs RSDic) sizeStats() Stats {
+	st := Stats{
+		BitsBytes:       floor(rs.codeLen, kSmallBlockSize) * 8,
+		PointerBytes:    rs.denseBlockLength * 8,
+		RankBytes:       rs.denseBlockLength * 8,
+		SelectOneBytes:  rs.selectOneLength * 8,
+		SelectZeroBytes: rs.selectZeroLength * 8,
+		RankSmallBytes:  rs.denseBlockLength * kSmallBlockPerLargeBlock,
+		RunBytes:        rs.runBlockLength * kRunBlockWords * 8,
+	}
+	st.TotalBytes = st.BitsBytes + st.PointerBytes + st.RankBytes + st.SelectOneBytes +
+		st.SelectZeroBytes + st.RankSmallBytes + st.RunBytes
+	return st
+}
+
+// AllocSize returns the allocated size in bytes, i.e. Stats().TotalBytes,
+// without reading the blocks.
+func (rs RSDic) AllocSize() int {
+	return int(rs.sizeStats().TotalBytes)
+}
@@ -0,0 +1,234 @@
+package rsdic
+
+import "fmt"
+
+// Truncate drops the bits after the first newNum bits of B.
+//
+// The result is the same as pushing back only the first newNum bits, except
+// that the large blocks before the new last one are kept as they are stored.
+// The files are shrunk to the new last large block, which is restored in memory
+// together with the last small block and the write buffer, and the select
+// samples from the new last large block are dropped, as are the updates by Set after it.
+// The reader is reloaded (so that the bits pushed back before Truncate are
+// also visible to queries after it), and thus copies of rs made before Truncate
+// must not be used. PushBack can continue after Truncate.
+//
+// Truncate rewrites the files in place, and thus requires the writer to be
+// loaded, whose exclusive lock of the directory keeps other processes from
+// mapping the files (See lock.go).
+func (rs *RSDic) Truncate(newNum uint64) error {
+	if rs.readOnly {
+		return errReadOnly
+	}
+	if !rs.writeLocked {
+		return fmt.Errorf("rsdic: Truncate: the writer of %s is not loaded", rs.path)
+	}
+	if newNum > rs.num {
+		return fmt.Errorf("rsdic: Truncate: length %d is larger than num = %d", newNum, rs.num)
+	}
+	if newNum == rs.num {
+		return nil
+	}
+	// the files may have grown by PushBack after the reader was loaded
+	if err := rs.reloadFiles(); err != nil {
+		return err
+	}
+	if rs.cache != nil {
+		rs.cache.purge()
+	}
+	if newNum == 0 {
+		return rs.truncateAll()
+	}
+
+	// the last small block and large block after truncation
+	lastSmall := floor(newNum, kSmallBlockSize) - 1
+	last := lastSmall / kSmallBlockPerLargeBlock
+	lb := rs.lblockAt(last)
+	pendSmall := make([]uint8, 0, kSmallBlockPerLargeBlock)
+	for i := uint64(0); i < lastSmall%kSmallBlockPerLargeBlock; i++ {
+		switch {
+		case !lb.run:
+			pendSmall = append(pendSmall, rs.smallRank(lb, i))
+		case lb.bit:
+			pendSmall = append(pendSmall, kSmallBlockSize)
+		default:
+			pendSmall = append(pendSmall, 0)
+		}
+	}
+	pendPointer := lb.pointer
+	if lb.run {
+		pendPointer = rs.pendPointer
+		if lb.phys < rs.denseBlockLength {
+			pendPointer = readUint64(rs.reader.pointerReader, lb.phys)
+		}
+	}
+	codeLen := pendPointer
+	for _, rankSB := range pendSmall {
+		codeLen += uint64(kEnumCodeLength[rankSB])
+	}
+	// the stored bits, to which the remaining updates still apply
+	stored := rs.stored()
+	lastBlock := stored.newWordReader(lastSmall).next()
+	if n := newNum - lastSmall*kSmallBlockSize; n < kSmallBlockSize {
+		lastBlock &= (1 << n) - 1
+	}
+	oneNum := stored.Rank(newNum, true)
+
+	// the runs before the last large block, the last of which is kept in memory
+	// if it can still be extended
+	runs := []runBlock{}
+	for i := uint64(0); i < rs.runNum(); i++ {
+		run := rs.runAt(i)
+		if run.start >= last {
+			break
+		}
+		run.end = min(run.end, last)
+		runs = append(runs, run)
+	}
+	hasOpenRun := len(runs) > 0 && runs[len(runs)-1].end == last
+	var openRun runBlock
+	if hasOpenRun {
+		openRun = runs[len(runs)-1]
+		runs = runs[:len(runs)-1]
+	}
+
+	if err := rs.truncateBits(codeLen); err != nil {
+		return err
+	}
+	denseBlockLength := lb.phys
+	if err := rewriteTail(rs.path, POINTER_BLOCK_FN, denseBlockLength*8, nil); err != nil {
+		return err
+	}
+	if err := rewriteTail(rs.path, RANK_BLOCK_FN, denseBlockLength*8, nil); err != nil {
+		return err
+	}
+	if err := rewriteTail(rs.path, RANK_SMALL_BLOCK_FN, denseBlockLength*kSmallBlockPerLargeBlock, nil); err != nil {
+		return err
+	}
+	if err := rewriteTail(rs.path, RUN_BLOCK_FN, 0, runsToBytes(runs)); err != nil {
+		return err
+	}
+	// the samples before the last large block, except those in the runs
+	selectOneLength := floor(lb.rank, kSelectBlockSize)
+	selectZeroLength := floor(last*kLargeBlockSize-lb.rank, kSelectBlockSize)
+	if len(runs) > 0 || hasOpenRun {
+		lastRun := openRun
+		if !hasOpenRun {
+			lastRun = runs[len(runs)-1]
+		}
+		selectOneLength -= lastRun.samplesThrough(true)
+		selectZeroLength -= lastRun.samplesThrough(false)
+	}
+	if err := rewriteTail(rs.path, SELECT_ONE_IND_FN, selectOneLength*8, nil); err != nil {
+		return err
+	}
+	if err := rewriteTail(rs.path, SELECT_ZERO_IND_FN, selectZeroLength*8, nil); err != nil {
+		return err
+	}
+
+	rs.num = newNum
+	rs.oneNum = oneNum
+	rs.zeroNum = newNum - oneNum
+	rs.lastBlock = lastBlock
+	rs.lastOneNum = uint64(popCount(lastBlock))
+	rs.lastZeroNum = newNum - lastSmall*kSmallBlockSize - rs.lastOneNum
+	rs.rankBlockLength = last + 1
+	rs.rankSmBlockLength = lastSmall
+	rs.denseBlockLength = denseBlockLength
+	rs.runBlockLength = uint64(len(runs))
+	rs.selectOneLength = selectOneLength
+	rs.selectZeroLength = selectZeroLength
+	rs.openRun = openRun
+	rs.hasOpenRun = hasOpenRun
+	rs.pendRank = lb.rank
+	rs.pendPointer = pendPointer
+	rs.pendSmall = pendSmall
+	rs.sets = rs.sets[:countLess(rs.sets, newNum)]
+	rs.clears = rs.clears[:countLess(rs.clears, newNum)]
+	return rs.reloadFiles()
+}
+
+// truncateBits drops the codes after the first codeLen bits,
+// restoring the write buffer from the last words of the remaining codes.
+func (rs *RSDic) truncateBits(codeLen uint64) error {
+	size := max(2, floor(codeLen, kSmallBlockSize))
+	// the last words are read before the write buffer is overwritten
+	words := [2]uint64{}
+	for i := uint64(0); i < 2; i++ {
+		if word := size - 2 + i; word*kSmallBlockSize < codeLen {
+			words[i] = rs.bitsWord(word)
+		}
+	}
+	for i := uint64(0); i < 2; i++ {
+		word := size - 2 + i
+		rs.bits.writeBits[i] = words[i]
+		rs.bits.isSet[i] = word*kSmallBlockSize < codeLen
+		if end := codeLen - min(codeLen, word*kSmallBlockSize); end < kSmallBlockSize {
+			rs.bits.writeBits[i] &= (1 << end) - 1
+		}
+	}
+	if err := rewriteTail(rs.path, BITS_FN, (size-2)*8, nil); err != nil {
+		return err
+	}
+	rs.bits.writeBitsSize = size
+	rs.bits.numWritten = size - 2
+	rs.codeLen = codeLen
+	return nil
+}
+
+// truncateAll drops all bits.
+func (rs *RSDic) truncateAll() error {
+	for _, name := range []string{BITS_FN, POINTER_BLOCK_FN, RANK_BLOCK_FN, SELECT_ONE_IND_FN,
+		SELECT_ZERO_IND_FN, RANK_SMALL_BLOCK_FN, RUN_BLOCK_FN} {
+		if err := rewriteTail(rs.path, name, 0, nil); err != nil {
+			return err
+		}
+	}
+	rs.num = 0
+	rs.oneNum = 0
+	rs.zeroNum = 0
+	rs.lastBlock = 0
+	rs.lastOneNum = 0
+	rs.lastZeroNum = 0
+	rs.codeLen = 0
+	rs.bits = NewBits()
+	rs.rankBlockLength = 0
+	rs.rankSmBlockLength = 0
+	rs.denseBlockLength = 0
+	rs.runBlockLength = 0
+	rs.selectOneLength = 0
+	rs.selectZeroLength = 0
+	rs.openRun = runBlock{}
+	rs.hasOpenRun = false
+	rs.pendRank = 0
+	rs.pendPointer = 0
+	rs.pendSmall = rs.pendSmall[:0]
+	rs.sets = nil
+	rs.clears = nil
+	return rs.reloadFiles()
+}
+
+// bitsWord returns the i-th word of the codes, which is on disk or in the write buffer.
+func (rs *RSDic) bitsWord(i uint64) uint64 {
+	if i < rs.bits.numWritten {
+		return readUint64(rs.reader.bitsReader, i)
+	}
+	return rs.bits.writeBits[i-rs.bits.numWritten]
+}
+
+// reloadFiles reopens the reader and moves the writer to the ends of the files
+// after they are modified.
+func (rs *RSDic) reloadFiles() error {
+	if rs.reader != nil {
+		if err := rs.reader.Close(); err != nil {
+			return err
+		}
+	}
+	if err := rs.LoadReader(); err != nil {
+		return err
+	}
+	if rs.writer != nil {
+		return rs.writer.seekEnd()
+	}
+	return nil
+}
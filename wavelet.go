@@ -0,0 +1,377 @@
+package rsdic
+
+import (
+	"container/heap"
+	"fmt"
+	"math/bits"
+	"os"
+	"path"
+)
+
+// WaveletMatrix supports access, rank, select and range queries over
+// a sequence of uint32 values S[0...num).
+//
+// A value is split into levels bits, where levels is the bit length of
+// the largest value. The d-th level is a bit vector of the (levels-1-d)-th
+// bits of the values, ordered by the stable partition of the previous level
+// (those with zeros first), and is stored as an RSDic in the subdirectory
+// levelNN of the directory. The number of zeros of each level and the
+// metadata of the RSDics are stored in manifest.bin. Each query takes O(levels)
+// operations of the RSDics.
+//
+// As the queries don't modify it, WaveletMatrix is safe for concurrent queries.
+//
+// [1] "The Wavelet Matrix", Francisco Claude, Gonzalo Navarro and Alberto Ordonez, SPIRE 2012
+type WaveletMatrix struct {
+	path   string
+	num    uint64
+	levels []*RSDic
+	zeros  []uint64 // the number of zeros in each level
+}
+
+// waveletManifest is the content of manifest.bin.
+type waveletManifest struct {
+	Num    uint64
+	Zeros  []uint64
+	Levels [][]byte // MarshalBinary of the level RSDics
+}
+
+// ValueCount is a value and its number of occurrences.
+type ValueCount struct {
+	Value uint32
+	Count uint64
+}
+
+func waveletLevelPath(dir string, d int) string {
+	return path.Join(dir, fmt.Sprintf("level%02d", d))
+}
+
+// BuildWaveletMatrix returns a new WaveletMatrix at dir representing vals,
+// with its levels written and loaded for reading.
+func BuildWaveletMatrix(dir string, vals []uint32) (*WaveletMatrix, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	maxVal := uint32(0)
+	for _, val := range vals {
+		maxVal = max(maxVal, val)
+	}
+	levelNum := max(1, bits.Len32(maxVal))
+	wm := &WaveletMatrix{
+		path:   dir,
+		num:    uint64(len(vals)),
+		levels: make([]*RSDic, levelNum),
+		zeros:  make([]uint64, levelNum),
+	}
+	cur := append([]uint32{}, vals...)
+	next := make([]uint32, len(vals))
+	for d := 0; d < levelNum; d++ {
+		shift := levelNum - 1 - d
+		level, err := newOpOutput(waveletLevelPath(dir, d))
+		if err != nil {
+			wm.Close()
+			return nil, err
+		}
+		wm.levels[d] = level
+		word := uint64(0)
+		for i, val := range cur {
+			word |= uint64(val>>shift&1) << (i % kSmallBlockSize)
+			if i%kSmallBlockSize == kSmallBlockSize-1 || i == len(cur)-1 {
+				level.pushWord(word, uint64(i%kSmallBlockSize+1))
+				word = 0
+			}
+		}
+		if err := closeOpOutput(level); err != nil {
+			wm.Close()
+			return nil, err
+		}
+		// the values with zeros come first, in the same order
+		zeros := 0
+		for _, val := range cur {
+			if val>>shift&1 == 0 {
+				next[zeros] = val
+				zeros++
+			}
+		}
+		ones := zeros
+		for _, val := range cur {
+			if val>>shift&1 == 1 {
+				next[ones] = val
+				ones++
+			}
+		}
+		wm.zeros[d] = uint64(zeros)
+		cur, next = next, cur
+	}
+	if err := wm.writeManifest(); err != nil {
+		wm.Close()
+		return nil, err
+	}
+	return wm, nil
+}
+
+func (wm *WaveletMatrix) writeManifest() error {
+	manifest := waveletManifest{Num: wm.num, Zeros: wm.zeros}
+	for _, level := range wm.levels {
+		meta, err := level.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		manifest.Levels = append(manifest.Levels, meta)
+	}
+	return writeManifest(wm.path, manifest)
+}
+
+// OpenWaveletMatrix loads the WaveletMatrix at dir written by BuildWaveletMatrix.
+func OpenWaveletMatrix(dir string) (*WaveletMatrix, error) {
+	var manifest waveletManifest
+	if err := readManifest(dir, &manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest.Levels) != len(manifest.Zeros) {
+		return nil, fmt.Errorf("rsdic: manifest of %s has %d levels and %d zero counts", dir, len(manifest.Levels), len(manifest.Zeros))
+	}
+	wm := &WaveletMatrix{path: dir, num: manifest.Num, zeros: manifest.Zeros}
+	for d, meta := range manifest.Levels {
+		level, err := New(waveletLevelPath(dir, d))
+		if err != nil {
+			wm.Close()
+			return nil, err
+		}
+		if err := level.UnmarshalBinary(meta); err != nil {
+			wm.Close()
+			return nil, err
+		}
+		if err := level.LoadReader(); err != nil {
+			wm.Close()
+			return nil, err
+		}
+		wm.levels = append(wm.levels, level)
+	}
+	return wm, nil
+}
+
+// Close releases the readers of the levels.
+func (wm *WaveletMatrix) Close() error {
+	var err error
+	for _, level := range wm.levels {
+		if level == nil {
+			continue
+		}
+		if closeErr := level.CloseReader(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Num returns the number of values
+func (wm *WaveletMatrix) Num() uint64 {
+	return wm.num
+}
+
+// Levels returns the number of levels, i.e. the bit length of the largest value
+func (wm *WaveletMatrix) Levels() int {
+	return len(wm.levels)
+}
+
+// bitAt returns the bit of c used at the level d.
+func (wm *WaveletMatrix) bitAt(c uint64, d int) bool {
+	return c>>(len(wm.levels)-1-d)&1 == 1
+}
+
+// child returns the position in the next level of the position pos of the level d
+// following bit.
+func (wm *WaveletMatrix) child(d int, pos uint64, bit bool) uint64 {
+	if bit {
+		return wm.zeros[d] + wm.levels[d].Rank(pos, true)
+	}
+	return wm.levels[d].Rank(pos, false)
+}
+
+func (wm *WaveletMatrix) checkRange(name string, l uint64, r uint64) {
+	if l > r || r > wm.num {
+		panic(fmt.Sprintf("%s: range [%d, %d) is out of bounds (num = %d)", name, l, r, wm.num))
+	}
+}
+
+// Access returns S[i]
+func (wm *WaveletMatrix) Access(i uint64) uint32 {
+	if i >= wm.num {
+		panic(fmt.Sprintf("Access: position %d is out of bounds (num = %d)", i, wm.num))
+	}
+	val := uint32(0)
+	for d, level := range wm.levels {
+		bit, rank := level.BitAndRank(i)
+		val <<= 1
+		if bit {
+			val |= 1
+			i = wm.zeros[d] + rank
+		} else {
+			i = rank
+		}
+	}
+	return val
+}
+
+// accessRank returns S[i] and the number of S[i]'s in S[0...i) in a single traversal.
+func (wm *WaveletMatrix) accessRank(i uint64) (uint32, uint64) {
+	val, begin := uint32(0), uint64(0)
+	for d, level := range wm.levels {
+		bit, rank := level.BitAndRank(i)
+		val <<= 1
+		if bit {
+			val |= 1
+			i = wm.zeros[d] + rank
+		} else {
+			i = rank
+		}
+		begin = wm.child(d, begin, bit)
+	}
+	return val, i - begin
+}
+
+// Rank returns the number of c's in S[0...i)
+func (wm *WaveletMatrix) Rank(c uint32, i uint64) uint64 {
+	i = min(i, wm.num)
+	if bits.Len32(c) > len(wm.levels) {
+		return 0
+	}
+	begin, end := uint64(0), i
+	for d := range wm.levels {
+		bit := wm.bitAt(uint64(c), d)
+		begin = wm.child(d, begin, bit)
+		end = wm.child(d, end, bit)
+	}
+	return end - begin
+}
+
+// Select returns the position of (k+1)-th occurence of c in S
+// Select returns num if k+1 is larger than the number of c's.
+func (wm *WaveletMatrix) Select(c uint32, k uint64) uint64 {
+	if k >= wm.Rank(c, wm.num) {
+		return wm.num
+	}
+	// the position of the first c in the last level
+	begin := uint64(0)
+	for d := range wm.levels {
+		begin = wm.child(d, begin, wm.bitAt(uint64(c), d))
+	}
+	pos := begin + k
+	for d := len(wm.levels) - 1; d >= 0; d-- {
+		if wm.bitAt(uint64(c), d) {
+			pos = wm.levels[d].Select(pos-wm.zeros[d], true)
+		} else {
+			pos = wm.levels[d].Select(pos, false)
+		}
+	}
+	return pos
+}
+
+// Quantile returns the (k+1)-th smallest value in S[l...r)
+func (wm *WaveletMatrix) Quantile(l uint64, r uint64, k uint64) uint32 {
+	wm.checkRange("Quantile", l, r)
+	if k >= r-l {
+		panic(fmt.Sprintf("Quantile: rank %d is out of bounds (range length = %d)", k, r-l))
+	}
+	val := uint32(0)
+	for d, level := range wm.levels {
+		zl, zr := level.Rank(l, false), level.Rank(r, false)
+		val <<= 1
+		if k < zr-zl {
+			l, r = zl, zr
+		} else {
+			k -= zr - zl
+			val |= 1
+			l, r = wm.zeros[d]+l-zl, wm.zeros[d]+r-zr
+		}
+	}
+	return val
+}
+
+// RangeFreq returns the number of values v in S[l...r) with lo <= v <= hi
+func (wm *WaveletMatrix) RangeFreq(l uint64, r uint64, lo uint32, hi uint32) uint64 {
+	wm.checkRange("RangeFreq", l, r)
+	if lo > hi {
+		return 0
+	}
+	return wm.rankLess(l, r, uint64(hi)+1) - wm.rankLess(l, r, uint64(lo))
+}
+
+// rankLess returns the number of values less than c in S[l...r).
+func (wm *WaveletMatrix) rankLess(l uint64, r uint64, c uint64) uint64 {
+	if bits.Len64(c) > len(wm.levels) {
+		return r - l
+	}
+	less := uint64(0)
+	for d, level := range wm.levels {
+		zl, zr := level.Rank(l, false), level.Rank(r, false)
+		if wm.bitAt(c, d) {
+			less += zr - zl
+			l, r = wm.zeros[d]+l-zl, wm.zeros[d]+r-zr
+		} else {
+			l, r = zl, zr
+		}
+	}
+	return less
+}
+
+// TopK returns the k most frequent values in S[l...r) with their counts,
+// in the descending order of the counts (the ascending order of the values for ties).
+// Fewer values are returned if S[l...r) has less than k distinct values.
+func (wm *WaveletMatrix) TopK(l uint64, r uint64, k int) []ValueCount {
+	wm.checkRange("TopK", l, r)
+	result := []ValueCount{}
+	if l == r {
+		return result
+	}
+	// best-first search of the ranges of the values sharing a prefix,
+	// whose lengths bound the counts of the values under them
+	nodes := &waveletNodes{{l: l, r: r}}
+	for nodes.Len() > 0 && len(result) < k {
+		node := heap.Pop(nodes).(waveletNode)
+		if node.depth == len(wm.levels) {
+			result = append(result, ValueCount{Value: uint32(node.prefix), Count: node.r - node.l})
+			continue
+		}
+		d := node.depth
+		zl, zr := wm.levels[d].Rank(node.l, false), wm.levels[d].Rank(node.r, false)
+		shift := len(wm.levels) - 1 - d
+		if zl < zr {
+			heap.Push(nodes, waveletNode{depth: d + 1, prefix: node.prefix, l: zl, r: zr})
+		}
+		if ol, or := wm.zeros[d]+node.l-zl, wm.zeros[d]+node.r-zr; ol < or {
+			heap.Push(nodes, waveletNode{depth: d + 1, prefix: node.prefix | 1<<shift, l: ol, r: or})
+		}
+	}
+	return result
+}
+
+// waveletNode is the range [l, r) of the level depth of the values whose
+// first depth bits are those of prefix (and the other bits of prefix are zeros).
+type waveletNode struct {
+	depth  int
+	prefix uint64
+	l      uint64
+	r      uint64
+}
+
+// waveletNodes is a heap of nodes ordered by the lengths of the ranges (longest first),
+// and then by the values (smallest first).
+type waveletNodes []waveletNode
+
+func (h waveletNodes) Len() int { return len(h) }
+func (h waveletNodes) Less(i, j int) bool {
+	if h[i].r-h[i].l != h[j].r-h[j].l {
+		return h[i].r-h[i].l > h[j].r-h[j].l
+	}
+	return h[i].prefix < h[j].prefix
+}
+func (h waveletNodes) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *waveletNodes) Push(x any)   { *h = append(*h, x.(waveletNode)) }
+func (h *waveletNodes) Pop() any {
+	old := *h
+	node := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return node
+}
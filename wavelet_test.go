@@ -0,0 +1,110 @@
+package rsdic
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWaveletMatrix(t *testing.T) {
+	vals := make([]uint32, 20000)
+	for i := range vals {
+		if rand.Intn(100) == 0 {
+			vals[i] = rand.Uint32()
+		} else {
+			vals[i] = uint32(rand.ExpFloat64() * 20)
+		}
+	}
+	built, err := BuildWaveletMatrix("test/wavelet", vals)
+	if err != nil {
+		panic(err)
+	}
+	defer built.Close()
+
+	checkWaveletMatrix := func(wm *WaveletMatrix) {
+		So(wm.Num(), ShouldEqual, len(vals))
+		So(wm.Levels(), ShouldEqual, 32)
+		for n := 0; n < 100; n++ {
+			i := uint64(rand.Intn(len(vals)))
+			So(wm.Access(i), ShouldEqual, vals[i])
+			c := vals[rand.Intn(len(vals))]
+			rank := uint64(0)
+			for _, val := range vals[:i] {
+				if val == c {
+					rank++
+				}
+			}
+			So(wm.Rank(c, i), ShouldEqual, rank)
+			if pos := wm.Select(c, rank); pos < wm.Num() {
+				So(vals[pos], ShouldEqual, c)
+				So(wm.Rank(c, pos), ShouldEqual, rank)
+			} else {
+				So(wm.Rank(c, wm.Num()), ShouldEqual, rank)
+			}
+
+			l := uint64(rand.Intn(len(vals)))
+			r := l + uint64(rand.Intn(len(vals)-int(l))) + 1
+			sorted := append([]uint32{}, vals[l:r]...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+			k := uint64(rand.Intn(int(r - l)))
+			So(wm.Quantile(l, r, k), ShouldEqual, sorted[k])
+
+			lo, hi := uint32(rand.Intn(30)), uint32(rand.Intn(60))
+			freq := uint64(0)
+			counts := map[uint32]uint64{}
+			for _, val := range vals[l:r] {
+				if lo <= val && val <= hi {
+					freq++
+				}
+				counts[val]++
+			}
+			So(wm.RangeFreq(l, r, lo, hi), ShouldEqual, freq)
+
+			top := []ValueCount{}
+			for val, count := range counts {
+				top = append(top, ValueCount{val, count})
+			}
+			sort.Slice(top, func(i, j int) bool {
+				if top[i].Count != top[j].Count {
+					return top[i].Count > top[j].Count
+				}
+				return top[i].Value < top[j].Value
+			})
+			So(wm.TopK(l, r, 5), ShouldResemble, top[:min(5, len(top))])
+		}
+		So(wm.Rank(math.MaxUint32, wm.Num()), ShouldBeLessThanOrEqualTo, 1)
+		So(wm.RangeFreq(0, wm.Num(), 0, math.MaxUint32), ShouldEqual, wm.Num())
+		So(wm.TopK(3, 3, 5), ShouldBeEmpty)
+	}
+
+	Convey("When a wavelet matrix is built", t, func() {
+		checkWaveletMatrix(built)
+	})
+
+	Convey("When a wavelet matrix is opened", t, func() {
+		wm, err := OpenWaveletMatrix("test/wavelet")
+		So(err, ShouldBeNil)
+		defer wm.Close()
+		checkWaveletMatrix(wm)
+	})
+
+	Convey("When a wavelet matrix has small or no values", t, func() {
+		wm, err := BuildWaveletMatrix("test/wavelet_small", []uint32{0, 1, 0, 0})
+		So(err, ShouldBeNil)
+		So(wm.Levels(), ShouldEqual, 1)
+		So(wm.Rank(0, 4), ShouldEqual, 3)
+		So(wm.Rank(2, 4), ShouldEqual, 0)
+		So(wm.Select(0, 2), ShouldEqual, 3)
+		So(wm.Select(2, 0), ShouldEqual, 4)
+		So(wm.Close(), ShouldBeNil)
+
+		wm, err = BuildWaveletMatrix("test/wavelet_small", nil)
+		So(err, ShouldBeNil)
+		So(wm.Num(), ShouldEqual, 0)
+		So(wm.Rank(0, 0), ShouldEqual, 0)
+		So(wm.Close(), ShouldBeNil)
+	})
+}